@@ -6,9 +6,12 @@ import (
 	"log"
 	"password-guard-bot/config"
 	"password-guard-bot/internal/bot"
+	"password-guard-bot/pkg/breach"
 	"password-guard-bot/pkg/crypto"
+	"password-guard-bot/pkg/generator"
 	"password-guard-bot/pkg/logger"
 	"password-guard-bot/pkg/mongodb"
+	"password-guard-bot/pkg/strength"
 	"syscall"
 
 	"go.uber.org/zap"
@@ -53,11 +56,29 @@ func main() {
 	}
 	zapLogger.Info("DB connected successfully")
 
-	cryptoService, err := crypto.NewCryptoService(&cfg.Crypto.Iteration)
+	cryptoService, err := crypto.NewCryptoService(&cfg.Crypto)
 	if err != nil {
 		zapLogger.Fatalf("failed to create crypto service: %s", err)
 	}
 
+	if cfg.Crypto.KdfTarget > 0 {
+		zapLogger.Infof("Key derivation calibrated to %s: %s", cfg.Crypto.KdfTarget, cryptoService.Kdf())
+	} else {
+		zapLogger.Infof("Key derivation: %s", cryptoService.Kdf())
+	}
+
+	// The server key is mandatory, without it the stored data can't be
+	// opened and new data would be written without the pepper layer.
+	pepperKey, err := crypto.LoadPepperKey(cfg.Crypto.PepperKeyFile)
+	if err != nil {
+		zapLogger.Fatalf("failed to load pepper key: %s", err)
+	}
+
+	pepperService, err := crypto.NewPepperService(pepperKey)
+	if err != nil {
+		zapLogger.Fatalf("failed to create pepper service: %s", err)
+	}
+
 	// Repositories
 	botRepository, err := bot.NewRepository(db, cfg.MongoDbName, zapLogger)
 	if err != nil {
@@ -69,6 +90,45 @@ func main() {
 		zapLogger.Fatalf("failed to create bot repository indexes: %s", err)
 	}
 
+	migrated, err := botRepository.MigrateDataToEntries(context.Background())
+	if err != nil {
+		zapLogger.Fatalf("failed to migrate data to entries: %s", err)
+	}
+	if migrated > 0 {
+		zapLogger.Infof("Migrated the data of %d users to entries", migrated)
+	}
+
+	moved, err := botRepository.MigrateEntriesToCollection(context.Background())
+	if err != nil {
+		zapLogger.Fatalf("failed to move entries to their collection: %s", err)
+	}
+	if moved > 0 {
+		zapLogger.Infof("Moved %d entries to their collection", moved)
+	}
+
+	rotationService, err := bot.NewRotationService(pepperService, botRepository, cfg.Crypto.PepperKeyFile, zapLogger)
+	if err != nil {
+		zapLogger.Fatalf("failed to create key rotation service: %s", err)
+	}
+
+	// Picks up the key of the last rotation and continues it if the bot
+	// stopped in the middle.
+	err = rotationService.Resume()
+	if err != nil {
+		zapLogger.Fatalf("failed to resume key rotation: %s", err)
+	}
+	zapLogger.Infof("Pepper key %s in use", pepperService.CurrentKeyId())
+
+	breachChecker := breach.NewNopChecker()
+	if cfg.BreachFile != "" {
+		breachChecker, err = breach.NewChecker(cfg.BreachFile)
+		if err != nil {
+			zapLogger.Fatalf("failed to open breach file: %s", err)
+		}
+	} else {
+		zapLogger.Info("BREACH_FILE is not set, passwords are not checked against breaches")
+	}
+
 	botApi, err := tgbotapi.NewBotAPI(cfg.TelegramKey)
 	if err != nil {
 		log.Panic(err)
@@ -80,12 +140,12 @@ func main() {
 		zapLogger.Fatalf("failed to create message service: %s", err)
 	}
 
-	botService, err := bot.NewService(botApi, cryptoService, botRepository, zapLogger)
+	botService, err := bot.NewService(botApi, cryptoService, pepperService, generator.NewGenerator(), strength.NewEstimator(), breachChecker, botRepository, cfg.HistoryDepth, zapLogger)
 	if err != nil {
 		zapLogger.Fatalf("failed to create bot service: %s", err)
 	}
 
-	botClient, err := bot.NewClient(botService, messageService, zapLogger)
+	botClient, err := bot.NewClient(botService, messageService, rotationService, cfg.AdminIds, zapLogger)
 	if err != nil {
 		zapLogger.Fatalf("failed to create bot service: %s", err)
 	}
@@ -2,14 +2,21 @@ package config
 
 import (
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Config struct {
-	Environment string `required:"true" envconfig:"APP_ENV"`
-	TelegramKey string `required:"true" envconfig:"TELEGRAM_KEY"`
+	Environment string  `required:"true" envconfig:"APP_ENV"`
+	TelegramKey string  `required:"true" envconfig:"TELEGRAM_KEY"`
+	AdminIds    []int64 `envconfig:"ADMIN_IDS"`
+	// Sorted SHA-1 file in the Pwned Passwords format, the breach check is
+	// off without it.
+	BreachFile string `envconfig:"BREACH_FILE"`
+	// Earlier versions kept per entry, 0 keeps none.
+	HistoryDepth int `default:"5" envconfig:"HISTORY_DEPTH"`
 
 	MongoDb
 	Crypto
@@ -21,7 +28,20 @@ type MongoDb struct {
 }
 
 type Crypto struct {
-	Iteration int `required:"true" envconfig:"ITERATION"`
+	Kdf             string `default:"pbkdf2" envconfig:"KDF"`
+	Iteration       int    `required:"true" envconfig:"ITERATION"`
+	LegacyIteration int    `envconfig:"LEGACY_ITERATION"`
+	ArgonMemory     uint32 `default:"65536" envconfig:"ARGON_MEMORY"`
+	ArgonTime       uint32 `default:"3" envconfig:"ARGON_TIME"`
+	ArgonThreads    uint8  `default:"4" envconfig:"ARGON_THREADS"`
+	PepperKeyFile   string `required:"true" envconfig:"PEPPER_KEY_FILE"`
+
+	// With KdfTarget set, the PBKDF2 iterations or the Argon2id time cost
+	// are calibrated at startup so one derivation takes about that long,
+	// within KdfMinCost and KdfMaxCost.
+	KdfTarget  time.Duration `envconfig:"KDF_TARGET"`
+	KdfMinCost int           `envconfig:"KDF_MIN_COST"`
+	KdfMaxCost int           `envconfig:"KDF_MAX_COST"`
 }
 
 var (
@@ -14,6 +14,8 @@ func TestInit(t *testing.T) {
 		mongoDbName string
 		mongoDbUrl  string
 		iteration   string
+		pepperKey   string
+		breachFile  string
 	}
 
 	type args struct {
@@ -26,6 +28,8 @@ func TestInit(t *testing.T) {
 		os.Setenv("MONGO_DB_NAME", env.mongoDbName)
 		os.Setenv("MONGO_DB_URL", env.mongoDbUrl)
 		os.Setenv("ITERATION", env.iteration)
+		os.Setenv("PEPPER_KEY_FILE", env.pepperKey)
+		os.Setenv("BREACH_FILE", env.breachFile)
 	}
 
 	tests := []struct {
@@ -43,17 +47,26 @@ func TestInit(t *testing.T) {
 					mongoDbName: "example",
 					mongoDbUrl:  "http://127.0.0.1",
 					iteration:   "1234",
+					pepperKey:   "pepper.key",
+					breachFile:  "pwned-passwords.txt",
 				},
 			},
 			want: &config.Config{
-				Environment: "development",
-				TelegramKey: "example",
+				Environment:  "development",
+				TelegramKey:  "example",
+				BreachFile:   "pwned-passwords.txt",
+				HistoryDepth: 5,
 				MongoDb: config.MongoDb{
 					MongoDbName: "example",
 					MongoDbUrl:  "http://127.0.0.1",
 				},
 				Crypto: config.Crypto{
-					Iteration: 1234,
+					Kdf:           "pbkdf2",
+					Iteration:     1234,
+					ArgonMemory:   65536,
+					ArgonTime:     3,
+					ArgonThreads:  4,
+					PepperKeyFile: "pepper.key",
 				},
 			},
 		},
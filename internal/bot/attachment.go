@@ -0,0 +1,190 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"password-guard-bot/pkg/secret"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// attachmentBucket is the GridFS bucket holding the attachments.
+const attachmentBucket = "attachments"
+
+// Attachment is a file of an entry. Its content is stored in the
+// attachments bucket, encrypted with the vault key as a stream of chunks.
+// The vault key is sealed with the pepper key, so the content needs it
+// too. Name is encrypted and sealed like an entry payload, the rest is
+// stored as GridFS metadata.
+type Attachment struct {
+	ID         primitive.ObjectID `bson:"-"`
+	TelegramId int64              `bson:"telegram_id"`
+	EntryId    primitive.ObjectID `bson:"entry_id"`
+	Name       string             `bson:"name"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
+
+// SaveAttachment encrypts src while it is read and stores it as an
+// attachment of the entry. The vault is created with pin if the user
+// doesn't have one yet.
+func (s *service) SaveAttachment(chatId int64, pin secret.Secret, entryId primitive.ObjectID, name string, src io.Reader) error {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.repository.GetEntry(context.Background(), chatId, entryId); err != nil {
+		return err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.openVault(user, normalizePin)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+
+	encryptedName, err := s.encryptWithKey(key, secret.New(name))
+	if err != nil {
+		return err
+	}
+
+	attachment := &Attachment{
+		ID:         primitive.NewObjectID(),
+		TelegramId: chatId,
+		EntryId:    entryId,
+		Name:       encryptedName,
+		CreatedAt:  time.Now(),
+	}
+
+	pr, pw := io.Pipe()
+	encrypted := make(chan error, 1)
+	go func() {
+		err := s.cryptoSvc.EncryptStream(key, pw, src)
+		pw.CloseWithError(err)
+		encrypted <- err
+	}()
+
+	err = s.repository.UploadAttachment(context.Background(), attachment, pr)
+	// Unblocks the encryption if the upload stopped early.
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	if encryptErr := <-encrypted; encryptErr != nil && err == nil {
+		err = encryptErr
+	}
+	if err != nil {
+		s.logger.Errorf("failed to save attachment: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetAttachmentButtons lists the attachments of the entry with their
+// decrypted names, oldest first. It returns nil if there are none.
+func (s *service) GetAttachmentButtons(chatId int64, pin secret.Secret, entryId primitive.ObjectID) ([][]tgbotapi.InlineKeyboardButton, error) {
+	attachments, err := s.repository.GetAttachments(context.Background(), chatId, entryId)
+	if err != nil || len(attachments) == 0 {
+		return nil, err
+	}
+
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizePin)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, attachment := range attachments {
+		name, err := s.decryptAttachmentName(key, &attachment)
+		if err != nil {
+			return nil, err
+		}
+
+		label := fmt.Sprintf("📎 %s", name)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(label, "attachment-"+attachment.ID.Hex())))
+	}
+
+	return rows, nil
+}
+
+// OpenAttachment returns the name of the attachment and its content,
+// decrypted while it is read. Reading fails if the stored content was
+// changed or cut off, the caller drops what it read so far then. The
+// caller closes the content.
+func (s *service) OpenAttachment(chatId int64, pin secret.Secret, id primitive.ObjectID) (string, io.ReadCloser, error) {
+	attachment, err := s.repository.GetAttachment(context.Background(), chatId, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return "", nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizePin)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name, err := s.decryptAttachmentName(key, attachment)
+	if err != nil {
+		key.Wipe()
+		return "", nil, err
+	}
+
+	stored, err := s.repository.OpenAttachment(context.Background(), id)
+	if err != nil {
+		key.Wipe()
+		return "", nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer key.Wipe()
+		defer stored.Close()
+
+		err := s.cryptoSvc.DecryptStream(key, pw, stored)
+		if err != nil && err != io.ErrClosedPipe {
+			s.logger.Errorf("failed to decrypt attachment: %s", err)
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return name, pr, nil
+}
+
+func (s *service) decryptAttachmentName(key secret.Secret, attachment *Attachment) (string, error) {
+	data, err := s.pepperSvc.Open(attachment.Name)
+	if err != nil {
+		s.logger.Errorf("failed to open pepper layer: %s", err)
+		return "", err
+	}
+
+	name, err := s.cryptoSvc.DecryptWithKey(key, data)
+	if err != nil {
+		s.logger.Errorf("failed to decrypt attachment name: %s", err)
+		return "", err
+	}
+
+	return string(name.Bytes()), nil
+}
@@ -3,35 +3,63 @@ package bot
 import (
 	"errors"
 	"fmt"
+	"html"
+	"password-guard-bot/pkg/crypto"
+	"password-guard-bot/pkg/generator"
+	"password-guard-bot/pkg/secret"
+	"password-guard-bot/pkg/strength"
+	"password-guard-bot/pkg/totp"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
+// maxPinAttempts limits how many wrong pins can be entered in a row before
+// the user has to start the command again.
+const maxPinAttempts = 3
+
+// maxRevealLength is the most text a revealed message holds. Telegram takes
+// 4096 UTF-16 code units without the markup, the self-destruct notice goes
+// in front.
+const maxRevealLength = 4000
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
 type Client interface {
 	StartBot(updates tgbotapi.UpdatesChannel)
 }
 
 type client struct {
-	botSvc     Service
-	messageSvc MessageService
-	logger     *zap.SugaredLogger
+	botSvc      Service
+	messageSvc  MessageService
+	rotationSvc RotationService
+	adminIds    []int64
+	logger      *zap.SugaredLogger
 }
 
-func NewClient(botSvc Service, messageSvc MessageService, logger *zap.SugaredLogger) (Client, error) {
+func NewClient(botSvc Service, messageSvc MessageService, rotationSvc RotationService, adminIds []int64, logger *zap.SugaredLogger) (Client, error) {
 	if botSvc == nil {
 		return nil, errors.New("invalid bot service")
 	}
 	if messageSvc == nil {
 		return nil, errors.New("invalid message service")
 	}
+	if rotationSvc == nil {
+		return nil, errors.New("invalid key rotation service")
+	}
 	if logger == nil {
 		return nil, errors.New("invalid logger")
 	}
 
-	return &client{botSvc: botSvc, messageSvc: messageSvc, logger: logger}, nil
+	return &client{botSvc: botSvc, messageSvc: messageSvc, rotationSvc: rotationSvc, adminIds: adminIds, logger: logger}, nil
 }
 
 func (c *client) StartBot(updates tgbotapi.UpdatesChannel) {
@@ -69,300 +97,2236 @@ func (c *client) StartBot(updates tgbotapi.UpdatesChannel) {
 
 						user.UpdateState("pin-encrypt")
 
-						c.messageSvc.AskPin(update.Message.Chat.ID, true)
+						c.askPin(update.Message.Chat.ID)
 						continue
 					case "pin-encrypt":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
 						user.UpdatePin(update.Message.Text)
-						user.UpdateState("login")
 
-						c.messageSvc.AskLogin(update.Message.Chat.ID)
+						created, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin)
+						if err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						if created {
+							c.offerRecoveryCodes(user, update.Message.Chat.ID, "login")
+							continue
+						}
+
+						c.askFirstField(user, update.Message.Chat.ID)
 						continue
 					case "pin-decrypt":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
 						user.UpdatePin(update.Message.Text)
 
-						dec, err := c.botSvc.DecryptData(update.Message.Chat.ID, user.Pin, user.From)
+						entry, err := c.botSvc.GetEntry(update.Message.Chat.ID, user.Pin, user.EntryId)
 						if err != nil {
-							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							c.handlePinError(err, user, update.Message.Chat.ID)
 							continue
 						}
 
-						msg := c.messageSvc.SendManualMessage(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("🟠 NOTICE: This message will be delete in 10 seconds. \nYour data: %q", *dec)))
+						// entry still has the usage from before this access.
+						c.sendEntry(update.Message.Chat.ID, "", entry, "\n🕓 "+html.EscapeString(usageText(entry, time.Now())))
 
-						go func(chatId int64, messageId int) {
-							time.Sleep(10 * time.Second)
-							c.messageSvc.DeleteMessage(chatId, messageId)
-							c.messageSvc.SendManualMessage(tgbotapi.NewMessage(chatId, "Thanks for using.😌"))
-						}(update.Message.Chat.ID, msg.MessageID)
-
-						user.Refresh()
+						c.askReveal(user, update.Message.Chat.ID, entry)
+						entry.Wipe()
 						continue
-					case "pin-update":
+					case "pin-reveal":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
 						user.UpdatePin(update.Message.Text)
-						user.UpdateState("login")
 
-						c.messageSvc.AskLogin(update.Message.Chat.ID)
+						c.handleReveal(user, update.Message.Chat.ID)
 						continue
-					case "login":
+					case "pin-attach":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-						user.UpdateLogin(update.Message.Text)
-						user.UpdateState("password")
+						user.UpdatePin(update.Message.Text)
 
-						c.messageSvc.AskPassword(update.Message.Chat.ID)
+						created, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin)
+						if err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						if created {
+							c.offerRecoveryCodes(user, update.Message.Chat.ID, "attach-file")
+							continue
+						}
+
+						user.UpdateState("attach-file")
+						c.messageSvc.AskAttachment(update.Message.Chat.ID)
 						continue
-					case "password":
+					case "attach-file":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-						user.UpdatePassword(update.Message.Text)
+						document := update.Message.Document
+						if document == nil {
+							c.messageSvc.AskAttachment(update.Message.Chat.ID)
+							continue
+						}
 
-						encryptedData, err := c.botSvc.EncryptData(update.Message.Chat.ID, *user)
-						if err != nil {
-							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+						if document.FileSize > maxAttachmentSize {
+							c.messageSvc.SendAttachmentTooLarge(update.Message.Chat.ID)
 							continue
 						}
 
-						err = c.botSvc.UpdateUserEncryptedData(update.Message.Chat.ID, user.From, *encryptedData)
+						// The transfer can take a while, it doesn't hold up the
+						// other chats. It gets a copy of the pin, the state is
+						// done with it.
+						go c.saveAttachment(update.Message.Chat.ID, user.Pin.Clone(), user.EntryId, *document)
+
+						user.Refresh()
+						continue
+					case "pin-history-show":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdatePin(update.Message.Text)
+
+						entry, err := c.botSvc.GetEntryVersion(update.Message.Chat.ID, user.Pin, user.EntryId, user.Version)
 						if err != nil {
-							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							c.handlePinError(err, user, update.Message.Chat.ID)
 							continue
 						}
 
-						c.messageSvc.SendSuccessMessage(update.Message.Chat.ID)
+						c.sendEntry(update.Message.Chat.ID, fmt.Sprintf("Version from %s\n", entry.UpdatedAt.UTC().Format("2006-01-02 15:04 UTC")), entry, "")
+						entry.Wipe()
 
 						user.Refresh()
 						continue
-					default:
+					case "pin-history-restore":
 						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
-						continue
-					}
-				} else {
-					c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
-					continue
-				}
-			}
 
-			// Extract the command from the Message.
-			switch update.Message.Command() {
-			case "start":
-				c.messageSvc.SendWelcomeMessage(update.Message.Chat.ID)
+						user.UpdatePin(update.Message.Text)
 
-				if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
-					if mongo.IsDuplicateKeyError(err) {
+						if err := c.botSvc.RestoreEntryVersion(update.Message.Chat.ID, user.Pin, user.EntryId, user.Version); err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						c.messageSvc.SendVersionRestored(update.Message.Chat.ID)
+
+						user.Refresh()
 						continue
-					}
+					case "pin-otp":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-				}
-			case "enc":
-				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						user.UpdatePin(update.Message.Text)
 
-				if !ok {
-					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
-						if mongo.IsDuplicateKeyError(err) {
+						name, code, remaining, err := c.botSvc.GetOtpCode(update.Message.Chat.ID, user.Pin, user.EntryId)
+						if err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
 							continue
 						}
 
-						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					}
-				}
+						c.sendSelfDestructing(update.Message.Chat.ID, fmt.Sprintf("Code for %s: %s\nValid for %d more seconds.", name, code, remaining), 10*time.Second)
 
-				user_state[update.Message.Chat.ID] = &UserState{
-					State: "from",
-				}
-				c.messageSvc.SendStartEncryptProcess(update.Message.Chat.ID)
-			case "dec":
-				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						user.Refresh()
+						continue
+					case "otp-name":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-				if !ok {
-					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
-						if mongo.IsDuplicateKeyError(err) {
+						ok, err := c.botSvc.CheckDuplicateOtpName(update.Message.Chat.ID, update.Message.Text)
+						if err != nil {
+							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
 							continue
 						}
 
-						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					}
-				}
+						if ok {
+							c.messageSvc.SendAlreadyHaveOtpName(update.Message.Chat.ID)
+							continue
+						}
 
-				userDataNameChunks, err := c.botSvc.GetUserDataNamesByChunks(update.Message.Chat.ID, 1)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						user.UpdateFrom(update.Message.Text)
+						user.UpdateState("pin-otp-add")
 
-				if userDataNameChunks == nil {
-					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
-					continue
-				}
+						c.askPin(update.Message.Chat.ID)
+						continue
+					case "pin-otp-add":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-				user_state[update.Message.Chat.ID] = &UserState{
-					Page:  1,
-					State: "decrypt",
-				}
+						user.UpdatePin(update.Message.Text)
 
-				c.messageSvc.AskWhatDecrypt(update.Message.Chat.ID, userDataNameChunks)
-			case "upd":
-				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						created, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin)
+						if err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
 
-				if !ok {
-					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
-						if mongo.IsDuplicateKeyError(err) {
+						if created {
+							c.offerRecoveryCodes(user, update.Message.Chat.ID, "otp-secret")
 							continue
 						}
 
-						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					}
-				}
+						user.UpdateState("otp-secret")
 
-				userDataNameChunks, err := c.botSvc.GetUserDataNamesByChunks(update.Message.Chat.ID, 1)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						c.messageSvc.AskOtpSecret(update.Message.Chat.ID)
+						continue
+					case "otp-secret":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-				if userDataNameChunks == nil {
-					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
-					continue
-				}
+						if err := c.botSvc.SaveOtp(update.Message.Chat.ID, user.Pin, user.From, secret.New(update.Message.Text)); err != nil {
+							if errors.Is(err, totp.ErrInvalidSecret) {
+								c.messageSvc.SendInvalidOtpSecret(update.Message.Chat.ID)
+								continue
+							}
 
-				user_state[update.Message.Chat.ID] = &UserState{
-					Page:  1,
-					State: "update",
-				}
+							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							user.Refresh()
+							continue
+						}
 
-				c.messageSvc.AskWhatUpdate(update.Message.Chat.ID, userDataNameChunks)
-			case "del":
-				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						c.messageSvc.SendOtpAdded(update.Message.Chat.ID)
 
-				if !ok {
-					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
-						if mongo.IsDuplicateKeyError(err) {
+						user.Refresh()
+						continue
+					case "pin-update":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdatePin(update.Message.Text)
+
+						created, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin)
+						if err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
 							continue
 						}
 
-						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					}
-				}
+						// The custom fields are kept unless they are removed
+						// in their step, the other fields are entered again.
+						entry, err := c.botSvc.PeekEntry(update.Message.Chat.ID, user.Pin, user.EntryId)
+						if err != nil {
+							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							user.Refresh()
+							continue
+						}
 
-				userDataNameChunks, err := c.botSvc.GetUserDataNamesByChunks(update.Message.Chat.ID, 1)
-				if err != nil {
-					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
-					continue
-				}
+						user.UpdateFrom(entry.Name)
+						user.UpdateType(entry.Type)
+						user.UpdateFields(entry.Fields)
+						entry.Fields = nil
+						entry.Wipe()
 
-				if userDataNameChunks == nil {
-					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
-					continue
-				}
+						if created {
+							c.offerRecoveryCodes(user, update.Message.Chat.ID, "login")
+							continue
+						}
 
-				user_state[update.Message.Chat.ID] = &UserState{
-					Page:  1,
-					State: "delete",
-				}
+						c.askFirstField(user, update.Message.Chat.ID)
+						continue
+					case "pin-change-current":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-				c.messageSvc.AskWhatDelete(update.Message.Chat.ID, userDataNameChunks)
-			default:
-				c.messageSvc.SendIncorrectCommand(update.Message.Chat.ID)
-			}
-		} else if update.CallbackQuery != nil {
-			c.messageSvc.DeleteMessage(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID)
+						user.UpdatePin(update.Message.Text)
 
-			if user, ok := user_state[update.CallbackQuery.Message.Chat.ID]; ok {
-				if user.State == "decrypt" {
-					if update.CallbackQuery.Data == "next" || update.CallbackQuery.Data == "prev" {
-						c.handlePagination(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID)
-						continue
-					}
+						if _, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin); err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
 
-					user.UpdateFrom(update.CallbackQuery.Data)
-					user.UpdateState("pin-decrypt")
-					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
-				}
+						user.UpdateState("pin-change-new")
 
-				if user.State == "update" {
-					if update.CallbackQuery.Data == "next" || update.CallbackQuery.Data == "prev" {
-						c.handlePagination(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID)
+						c.messageSvc.AskNewPin(update.Message.Chat.ID)
 						continue
-					}
+					case "pin-change-new":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-					user.UpdateFrom(update.CallbackQuery.Data)
-					user.UpdateState("pin-update")
-					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
-				}
+						user.UpdateNewPin(update.Message.Text)
+						user.UpdateState("pin-change-confirm")
 
-				if user.State == "delete" {
-					if update.CallbackQuery.Data == "next" || update.CallbackQuery.Data == "prev" {
-						c.handlePagination(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID)
+						c.messageSvc.AskConfirmPin(update.Message.Chat.ID)
 						continue
-					}
+					case "pin-change-confirm":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-					if err := c.botSvc.DeleteData(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Data); err != nil {
-						c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
-						continue
-					}
+						confirmPin := secret.New(update.Message.Text)
+						pinsMatch := confirmPin.Equal(user.NewPin)
+						confirmPin.Wipe()
 
-					c.messageSvc.SendSuccessDelete(update.CallbackQuery.Message.Chat.ID)
-				}
+						if !pinsMatch {
+							user.UpdateState("pin-change-new")
 
-				if user.State == "question-want-replace" {
-					switch update.CallbackQuery.Data {
-					case "yes":
-						user.UpdateState("pin-encrypt")
+							c.messageSvc.SendPinMismatch(update.Message.Chat.ID)
+							c.messageSvc.AskNewPin(update.Message.Chat.ID)
+							continue
+						}
 
-						c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, true)
-					case "no":
-						user.UpdateState("from")
+						skipped, err := c.botSvc.ChangePin(update.Message.Chat.ID, user.Pin, user.NewPin)
+						if err != nil {
+							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							user.Refresh()
+							continue
+						}
 
-						c.messageSvc.AskNewNameFromData(update.CallbackQuery.Message.Chat.ID)
-					}
-				}
-			}
-		}
-	}
-}
+						c.messageSvc.SendPinChanged(update.Message.Chat.ID)
+						if skipped > 0 {
+							c.messageSvc.SendEntriesSkipped(update.Message.Chat.ID, skipped)
+						}
 
-func (c *client) handlePagination(data string, user *UserState, chatId int64) {
-	switch data {
-	case "next":
-		user.IncPage()
+						user.Refresh()
+						continue
+					case "pin-codes":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
 
-		userDataNameChunks, err := c.botSvc.GetUserDataNamesByChunks(chatId, user.Page)
-		if err != nil {
-			c.messageSvc.SendWrongMessage(chatId)
-			return
-		}
+						user.UpdatePin(update.Message.Text)
 
-		c.messageSvc.AskWhatDecrypt(chatId, userDataNameChunks)
-	case "prev":
+						if err := c.sendRecoveryCodes(user, update.Message.Chat.ID); err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						user.Refresh()
+						continue
+					case "recover-code":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateRecovery(update.Message.Text)
+
+						if err := c.botSvc.CheckRecoveryCode(update.Message.Chat.ID, user.Recovery); err != nil {
+							c.handleRecoveryCodeError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						user.UpdateState("recover-new-pin")
+
+						c.messageSvc.AskNewPin(update.Message.Chat.ID)
+						continue
+					case "recover-new-pin":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateNewPin(update.Message.Text)
+						user.UpdateState("recover-confirm-pin")
+
+						c.messageSvc.AskConfirmPin(update.Message.Chat.ID)
+						continue
+					case "recover-confirm-pin":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						confirmPin := secret.New(update.Message.Text)
+						pinsMatch := confirmPin.Equal(user.NewPin)
+						confirmPin.Wipe()
+
+						if !pinsMatch {
+							user.UpdateState("recover-new-pin")
+
+							c.messageSvc.SendPinMismatch(update.Message.Chat.ID)
+							c.messageSvc.AskNewPin(update.Message.Chat.ID)
+							continue
+						}
+
+						// /recover_shares ends here as well.
+						if len(user.Shares) > 0 {
+							if err := c.botSvc.RecoverVaultWithShares(update.Message.Chat.ID, user.Shares, user.NewPin); err != nil {
+								c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+								user.Refresh()
+								continue
+							}
+
+							c.messageSvc.SendPinChanged(update.Message.Chat.ID)
+
+							user.Refresh()
+							continue
+						}
+
+						codesLeft, err := c.botSvc.RecoverVault(update.Message.Chat.ID, user.Recovery, user.NewPin)
+						if err != nil {
+							c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+							user.Refresh()
+							continue
+						}
+
+						c.messageSvc.SendVaultRecovered(update.Message.Chat.ID, codesLeft)
+
+						user.Refresh()
+						continue
+					case "pin-shares":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdatePin(update.Message.Text)
+
+						if _, err := c.botSvc.UnlockVault(update.Message.Chat.ID, user.Pin); err != nil {
+							c.handlePinError(err, user, update.Message.Chat.ID)
+							continue
+						}
+
+						user.UpdateState("shares-size")
+
+						c.messageSvc.AskSharesSize(update.Message.Chat.ID)
+						continue
+					case "shares-trustees":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						trustees, ok := parseTrustees(update.Message.Text, user.ShareCount)
+						if !ok {
+							c.messageSvc.SendInvalidTrustees(update.Message.Chat.ID, user.ShareCount)
+							continue
+						}
+
+						c.sendSharesToTrustees(user, update.Message.Chat.ID, trustees, displayName(update.Message.From))
+
+						user.Refresh()
+						continue
+					case "recover-share":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						share := update.Message.Text
+						if update.Message.Document != nil {
+							content, err := c.messageSvc.DownloadFile(update.Message.Document.FileID)
+							if err != nil {
+								c.logger.Errorf("failed to download share: %s", err)
+								c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+								continue
+							}
+
+							share = string(content)
+						}
+
+						user.AddShare(share)
+
+						needed, err := c.botSvc.CheckShares(update.Message.Chat.ID, user.Shares)
+						if err != nil {
+							switch {
+							case errors.Is(err, ErrInvalidShare):
+								user.DropLastShare()
+								c.messageSvc.SendInvalidShare(update.Message.Chat.ID)
+							case errors.Is(err, ErrWrongShares):
+								c.messageSvc.SendWrongShares(update.Message.Chat.ID)
+								user.Refresh()
+							default:
+								c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+								user.Refresh()
+							}
+							continue
+						}
+
+						if needed > 0 {
+							c.messageSvc.AskShare(update.Message.Chat.ID, needed)
+							continue
+						}
+
+						user.UpdateState("recover-new-pin")
+
+						c.messageSvc.AskNewPin(update.Message.Chat.ID)
+						continue
+					case "login":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateLogin(update.Message.Text)
+
+						// A password from /gen is already filled in.
+						if !user.Password.IsEmpty() {
+							c.askURL(user, update.Message.Chat.ID)
+							continue
+						}
+
+						user.UpdateState("password")
+
+						c.messageSvc.AskPassword(update.Message.Chat.ID)
+						continue
+					case "password":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdatePassword(update.Message.Text)
+
+						result := c.botSvc.EstimatePasswordStrength(*user)
+						breaches := c.botSvc.CountPasswordBreaches(*user)
+						if result.Score < strength.Acceptable || breaches > 0 {
+							user.UpdateState("password-weak")
+
+							c.messageSvc.SendPasswordWarning(update.Message.Chat.ID, result, breaches)
+							continue
+						}
+
+						c.askURL(user, update.Message.Chat.ID)
+						continue
+					case "url":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateURL(update.Message.Text)
+						user.UpdateState("notes")
+
+						c.messageSvc.AskNotes(update.Message.Chat.ID)
+						continue
+					case "notes":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateNotes(update.Message.Text)
+
+						c.askFields(user, update.Message.Chat.ID)
+						continue
+					case "field-name":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						name := strings.TrimSpace(update.Message.Text)
+						if name == "" {
+							c.askFields(user, update.Message.Chat.ID)
+							continue
+						}
+
+						user.UpdateFieldName(name)
+						user.UpdateState("field-value")
+
+						c.messageSvc.AskFieldValue(update.Message.Chat.ID, name)
+						continue
+					case "field-value":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateFieldValue(update.Message.Text)
+						user.UpdateState("field-hidden")
+
+						c.messageSvc.AskFieldHidden(update.Message.Chat.ID)
+						continue
+					case "note-content":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateContent(update.Message.Text)
+
+						c.askFolder(user, update.Message.Chat.ID)
+						continue
+					case "find", "find-result":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						c.findEntries(user, update.Message.Chat.ID, update.Message.Text)
+						continue
+					case "folder":
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+
+						user.UpdateFolder(parseFolder(update.Message.Text))
+
+						c.saveEncryptedData(user, update.Message.Chat.ID)
+						continue
+					default:
+						c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+						continue
+					}
+				} else {
+					c.messageSvc.DeleteMessage(update.Message.Chat.ID, update.Message.MessageID)
+					continue
+				}
+			}
+
+			// A command starts over, wipe whatever the previous one left
+			// behind before its state is replaced.
+			if user, ok := user_state[update.Message.Chat.ID]; ok {
+				user.Refresh()
+				delete(user_state, update.Message.Chat.ID)
+			}
+
+			// Extract the command from the Message.
+			switch update.Message.Command() {
+			case "start":
+				c.messageSvc.SendWelcomeMessage(update.Message.Chat.ID)
+
+				if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+					if mongo.IsDuplicateKeyError(err) {
+						continue
+					}
+
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+				}
+			case "enc":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "from",
+				}
+				c.messageSvc.SendStartEncryptProcess(update.Message.Chat.ID)
+			case "note":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "from",
+					Type:  entryTypeNote,
+				}
+				c.messageSvc.SendStartNoteProcess(update.Message.Chat.ID)
+			case "dec":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "decrypt",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "upd":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "update",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "del":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "delete",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "history":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "history",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "fav":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "favorite",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "settings":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil && !mongo.IsDuplicateKeyError(err) {
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+						continue
+					}
+				}
+
+				settings, err := c.botSvc.GetSettings(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "settings",
+				}
+
+				c.messageSvc.AskEntryOrder(update.Message.Chat.ID, settings.EntryOrder)
+			case "info":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "info",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "attach":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user := &UserState{
+					Page:  1,
+					State: "attach",
+				}
+
+				ok, err = c.sendEntryPicker(user, update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = user
+			case "find":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendDoNotHaveData(update.Message.Chat.ID)
+					continue
+				}
+
+				user := &UserState{
+					State: "find",
+				}
+				user_state[update.Message.Chat.ID] = user
+
+				if query := update.Message.CommandArguments(); strings.TrimSpace(query) != "" {
+					c.findEntries(user, update.Message.Chat.ID, query)
+					continue
+				}
+
+				c.messageSvc.AskFindQuery(update.Message.Chat.ID)
+			case "pin":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				hasVault, err := c.botSvc.HasVault(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !hasVault {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "pin-change-current",
+				}
+
+				c.messageSvc.AskCurrentPin(update.Message.Chat.ID)
+			case "codes":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				hasVault, err := c.botSvc.HasVault(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !hasVault {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "pin-codes",
+				}
+
+				c.messageSvc.AskPin(update.Message.Chat.ID, false)
+			case "recover":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				hasVault, err := c.botSvc.HasVault(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !hasVault {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				codes, err := c.botSvc.CountRecoveryCodes(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if codes == 0 {
+					c.messageSvc.SendNoRecoveryCodes(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "recover-code",
+				}
+
+				c.messageSvc.AskRecoveryCode(update.Message.Chat.ID)
+			case "shares":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				hasVault, err := c.botSvc.HasVault(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !hasVault {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "pin-shares",
+				}
+
+				c.messageSvc.AskPin(update.Message.Chat.ID, false)
+			// Telegram commands can't contain a dash.
+			case "recover_shares":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					c.messageSvc.SendNoPin(update.Message.Chat.ID)
+					continue
+				}
+
+				threshold, err := c.botSvc.GetShareThreshold(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if threshold == 0 {
+					c.messageSvc.SendNoShares(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					State: "recover-share",
+				}
+
+				c.messageSvc.AskShare(update.Message.Chat.ID, threshold)
+			case "gen":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				user := &UserState{
+					State:      "generate",
+					GenOptions: generator.DefaultOptions(),
+				}
+				user_state[update.Message.Chat.ID] = user
+
+				if err := c.sendGenerated(user, update.Message.Chat.ID); err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+				}
+			case "otp":
+				ok, err := c.botSvc.CheckExistUser(update.Message.Chat.ID)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				if !ok {
+					if err := c.botSvc.CreateUser(update.Message.Chat.ID); err != nil {
+						if mongo.IsDuplicateKeyError(err) {
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					}
+				}
+
+				userOtpNameChunks, err := c.botSvc.GetUserOtpNamesByChunks(update.Message.Chat.ID, 1)
+				if err != nil {
+					c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+					continue
+				}
+
+				user_state[update.Message.Chat.ID] = &UserState{
+					Page:  1,
+					State: "otp",
+				}
+
+				c.messageSvc.AskWhatOtp(update.Message.Chat.ID, userOtpNameChunks)
+			case "rotate":
+				// Not advertised, regular users get the same answer as for
+				// any unknown command.
+				if !c.isAdmin(update.Message.Chat.ID) {
+					c.messageSvc.SendIncorrectCommand(update.Message.Chat.ID)
+					continue
+				}
+
+				keyFile := strings.TrimSpace(update.Message.CommandArguments())
+				if keyFile == "" {
+					rotation, err := c.rotationSvc.Status()
+					if err != nil {
+						if err == mongo.ErrNoDocuments {
+							c.messageSvc.SendNoKeyRotation(update.Message.Chat.ID)
+							continue
+						}
+
+						c.messageSvc.SendWrongMessage(update.Message.Chat.ID)
+						continue
+					}
+
+					c.messageSvc.SendKeyRotationStatus(update.Message.Chat.ID, rotation)
+					continue
+				}
+
+				rotation, err := c.rotationSvc.Start(keyFile)
+				if err != nil {
+					c.messageSvc.SendKeyRotationFailed(update.Message.Chat.ID, err)
+					continue
+				}
+
+				c.messageSvc.SendKeyRotationStatus(update.Message.Chat.ID, rotation)
+			default:
+				c.messageSvc.SendIncorrectCommand(update.Message.Chat.ID)
+			}
+		} else if update.CallbackQuery != nil {
+			c.messageSvc.DeleteMessage(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID)
+
+			if user, ok := user_state[update.CallbackQuery.Message.Chat.ID]; ok {
+				if user.State == "decrypt" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					user.UpdateState("pin-decrypt")
+					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
+				}
+
+				if user.State == "update" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					user.UpdateState("pin-update")
+					c.askPin(update.CallbackQuery.Message.Chat.ID)
+				}
+
+				if user.State == "delete" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					if err := c.botSvc.DeleteEntry(update.CallbackQuery.Message.Chat.ID, user.EntryId); err != nil {
+						c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						continue
+					}
+
+					c.messageSvc.SendSuccessDelete(update.CallbackQuery.Message.Chat.ID)
+				}
+
+				if user.State == "otp" {
+					if update.CallbackQuery.Data == "next" || update.CallbackQuery.Data == "prev" {
+						c.handlePagination(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID)
+						continue
+					}
+
+					if update.CallbackQuery.Data == "otp-add" {
+						user.UpdateState("otp-name")
+						c.messageSvc.AskOtpName(update.CallbackQuery.Message.Chat.ID)
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					user.UpdateState("pin-otp")
+					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
+				}
+
+				if user.State == "history" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+
+					versions, err := c.botSvc.GetEntryVersionButtons(update.CallbackQuery.Message.Chat.ID, user.EntryId)
+					if err != nil {
+						c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						user.Refresh()
+						continue
+					}
+
+					if versions == nil {
+						c.messageSvc.SendNoHistory(update.CallbackQuery.Message.Chat.ID)
+						user.Refresh()
+						continue
+					}
+
+					user.UpdateState("history-version")
+					c.messageSvc.AskWhichVersion(update.CallbackQuery.Message.Chat.ID, versions)
+					continue
+				}
+
+				if user.State == "info" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					c.sendEntryDetails(user, update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "favorite" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+
+					favorite, err := c.botSvc.ToggleFavorite(update.CallbackQuery.Message.Chat.ID, user.EntryId)
+					if err != nil {
+						c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						user.Refresh()
+						continue
+					}
+
+					c.messageSvc.SendFavorite(update.CallbackQuery.Message.Chat.ID, favorite)
+					user.Refresh()
+					continue
+				}
+
+				if user.State == "settings" {
+					var order string
+					switch update.CallbackQuery.Data {
+					case "order-name":
+						order = entryOrderName
+					case "order-recent":
+						order = entryOrderRecent
+					case "order-frequent":
+						order = entryOrderFrequent
+					default:
+						continue
+					}
+
+					if err := c.botSvc.UpdateEntryOrder(update.CallbackQuery.Message.Chat.ID, order); err != nil {
+						c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						user.Refresh()
+						continue
+					}
+
+					c.messageSvc.SendSettingsSaved(update.CallbackQuery.Message.Chat.ID)
+					user.Refresh()
+					continue
+				}
+
+				if user.State == "attach" {
+					if c.handleEntryPicker(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID) {
+						continue
+					}
+
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					user.UpdateState("pin-attach")
+					c.askPin(update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "reveal" {
+					user.UpdateReveal(update.CallbackQuery.Data)
+					user.UpdateState("pin-reveal")
+					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
+					continue
+				}
+
+				if user.State == "history-version" {
+					var version int
+					if _, err := fmt.Sscanf(update.CallbackQuery.Data, "version-%d", &version); err != nil {
+						continue
+					}
+
+					user.UpdateVersion(version)
+					user.UpdateState("history-action")
+
+					c.messageSvc.AskVersionAction(update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "history-action" {
+					switch update.CallbackQuery.Data {
+					case "version-show":
+						user.UpdateState("pin-history-show")
+					case "version-restore":
+						user.UpdateState("pin-history-restore")
+					default:
+						continue
+					}
+
+					c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
+					continue
+				}
+
+				if user.State == "find-result" {
+					user.UpdateEntryId(update.CallbackQuery.Data)
+					user.UpdateState("find-action")
+
+					c.messageSvc.AskEntryAction(update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "find-action" {
+					switch update.CallbackQuery.Data {
+					case "entry-decrypt":
+						user.UpdateState("pin-decrypt")
+						c.messageSvc.AskPin(update.CallbackQuery.Message.Chat.ID, false)
+					case "entry-update":
+						user.UpdateState("pin-update")
+						c.askPin(update.CallbackQuery.Message.Chat.ID)
+					case "entry-delete":
+						if err := c.botSvc.DeleteEntry(update.CallbackQuery.Message.Chat.ID, user.EntryId); err != nil {
+							c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+							continue
+						}
+
+						c.messageSvc.SendSuccessDelete(update.CallbackQuery.Message.Chat.ID)
+						user.Refresh()
+					case "entry-details":
+						c.sendEntryDetails(user, update.CallbackQuery.Message.Chat.ID)
+					}
+					continue
+				}
+
+				if user.State == "password-weak" {
+					switch update.CallbackQuery.Data {
+					case "weak-keep":
+						c.askURL(user, update.CallbackQuery.Message.Chat.ID)
+					case "weak-generate":
+						user.UpdateState("generate")
+						user.UpdateGenOptions(generator.DefaultOptions())
+
+						if err := c.sendGenerated(user, update.CallbackQuery.Message.Chat.ID); err != nil {
+							c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						}
+					}
+					continue
+				}
+
+				if user.State == "recovery-offer" {
+					if update.CallbackQuery.Data == "recovery-yes" {
+						if err := c.sendRecoveryCodes(user, update.CallbackQuery.Message.Chat.ID); err != nil {
+							c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+						}
+					}
+
+					c.continueAfterRecoveryOffer(user, update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "shares-size" {
+					var threshold, count int
+					if _, err := fmt.Sscanf(update.CallbackQuery.Data, "shares-%d-%d", &threshold, &count); err != nil {
+						continue
+					}
+
+					user.UpdateShareSize(threshold, count)
+					user.UpdateState("shares-delivery")
+
+					c.messageSvc.AskSharesDelivery(update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "shares-delivery" {
+					switch update.CallbackQuery.Data {
+					case "shares-documents":
+						shareSet, shares, err := c.botSvc.SplitVaultKey(update.CallbackQuery.Message.Chat.ID, user.Pin, user.ShareCount, user.ShareThreshold)
+						if err != nil {
+							c.messageSvc.SendWrongMessage(update.CallbackQuery.Message.Chat.ID)
+							user.Refresh()
+							continue
+						}
+
+						c.sendOwnShares(update.CallbackQuery.Message.Chat.ID, shareSet, shares, func(int) bool { return true })
+						wipeAll(shares)
+
+						c.messageSvc.SendSharesCreated(update.CallbackQuery.Message.Chat.ID, shareSet.Threshold, shareSet.Count)
+
+						user.Refresh()
+					case "shares-trusted":
+						user.UpdateState("shares-trustees")
+
+						c.messageSvc.AskTrustees(update.CallbackQuery.Message.Chat.ID, user.ShareCount)
+					}
+					continue
+				}
+
+				if user.State == "url" && update.CallbackQuery.Data == "skip" {
+					user.UpdateState("notes")
+
+					c.messageSvc.AskNotes(update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "notes" && update.CallbackQuery.Data == "skip" {
+					c.askFields(user, update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "field-name" {
+					switch update.CallbackQuery.Data {
+					case "fields-done":
+						c.askFolder(user, update.CallbackQuery.Message.Chat.ID)
+					case "fields-clear":
+						user.ClearFields()
+						c.askFields(user, update.CallbackQuery.Message.Chat.ID)
+					}
+					continue
+				}
+
+				if user.State == "field-hidden" {
+					switch update.CallbackQuery.Data {
+					case "field-hidden":
+						user.AddField(true)
+					case "field-visible":
+						user.AddField(false)
+					default:
+						continue
+					}
+
+					c.askFields(user, update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "folder" {
+					switch update.CallbackQuery.Data {
+					case "skip":
+					case "folder-none":
+						user.UpdateFolder("", nil)
+					default:
+						continue
+					}
+
+					c.saveEncryptedData(user, update.CallbackQuery.Message.Chat.ID)
+					continue
+				}
+
+				if user.State == "generate" {
+					c.handleGenerator(update.CallbackQuery.Data, user, update.CallbackQuery.Message.Chat.ID)
+				}
+
+				if user.State == "question-want-replace" {
+					switch update.CallbackQuery.Data {
+					case "yes":
+						user.UpdateState("pin-encrypt")
+
+						c.askPin(update.CallbackQuery.Message.Chat.ID)
+					case "no":
+						user.UpdateState("from")
+
+						c.messageSvc.AskNewNameFromData(update.CallbackQuery.Message.Chat.ID)
+					}
+				}
+			}
+		}
+	}
+}
+
+// askURL goes on with /enc and /upd once the password is settled, the
+// URL and the notes can be skipped.
+func (c *client) askURL(user *UserState, chatId int64) {
+	user.UpdateState("url")
+
+	c.messageSvc.AskURL(chatId)
+}
+
+// findEntries shows the entries matching query. Another search can be
+// entered instead of picking one, also if nothing matches.
+func (c *client) findEntries(user *UserState, chatId int64, query string) {
+	results, err := c.botSvc.FindEntries(chatId, query)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		user.Refresh()
+		return
+	}
+
+	if results == nil {
+		user.UpdateState("find")
+		c.messageSvc.SendNothingFound(chatId, query)
+		return
+	}
+
+	user.UpdateState("find-result")
+	c.messageSvc.AskWhatFound(chatId, results)
+}
+
+// askFirstField goes on with /enc, /note or /upd once the pin is checked:
+// a note only has its content, a login starts with the login.
+func (c *client) askFirstField(user *UserState, chatId int64) {
+	if user.Type == entryTypeNote {
+		user.UpdateState("note-content")
+
+		c.messageSvc.AskNoteContent(chatId)
+		return
+	}
+
+	user.UpdateState("login")
+
+	c.messageSvc.AskLogin(chatId)
+}
+
+// askFields asks for another custom field of a login, until the user is
+// done with them.
+func (c *client) askFields(user *UserState, chatId int64) {
+	user.UpdateState("field-name")
+
+	c.messageSvc.AskCustomField(chatId, user.Fields)
+}
+
+// askFolder is the last step of /enc and /upd. An update keeps the folder
+// and the tags of the entry unless new ones are entered.
+func (c *client) askFolder(user *UserState, chatId int64) {
+	if !user.EntryId.IsZero() {
+		details, err := c.botSvc.GetEntryDetails(chatId, user.EntryId)
+		if err != nil {
+			c.messageSvc.SendWrongMessage(chatId)
+			user.Refresh()
+			return
+		}
+
+		user.UpdateFolder(details.Folder, details.Tags)
+	}
+
+	user.UpdateState("folder")
+
+	c.messageSvc.AskFolder(chatId, folderText(user.Folder, user.Tags))
+}
+
+// saveEncryptedData encrypts the collected fields and stores them as the
+// entry user.EntryId, or as a new entry named user.From.
+func (c *client) saveEncryptedData(user *UserState, chatId int64) {
+	entry := &Entry{
+		ID:       user.EntryId,
+		Name:     user.From,
+		Type:     user.Type,
+		Folder:   user.Folder,
+		Tags:     user.Tags,
+		Login:    user.Login.TrimSpace(),
+		Password: user.Password.TrimSpace(),
+		URL:      user.URL.TrimSpace(),
+		Notes:    user.Notes.TrimSpace(),
+		Content:  user.Content.Clone(),
+		Fields:   cloneFields(user.Fields),
+	}
+	defer entry.Wipe()
+
+	if err := c.botSvc.SaveEntry(chatId, user.Pin, entry); err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+
+	c.messageSvc.SendSuccessMessage(chatId)
+
+	user.Refresh()
+}
+
+func (c *client) handleGenerator(data string, user *UserState, chatId int64) {
+	if data == "gen-save" {
+		user.UseGenerated()
+
+		// Coming from a weak password in /enc or /upd, everything else is
+		// already filled in.
+		if !user.Login.IsEmpty() {
+			c.askURL(user, chatId)
+			return
+		}
+
+		user.UpdateState("from")
+
+		c.messageSvc.SendStartEncryptProcess(chatId)
+		return
+	}
+
+	previous := user.GenOptions
+	options := user.GenOptions
+
+	switch data {
+	case "gen-shorter":
+		if options.Passphrase {
+			options.Words = max(options.Words-1, generator.MinWords)
+		} else {
+			options.Length = max(options.Length-4, generator.MinLength)
+		}
+	case "gen-longer":
+		if options.Passphrase {
+			options.Words = min(options.Words+1, generator.MaxWords)
+		} else {
+			options.Length = min(options.Length+4, generator.MaxLength)
+		}
+	case "gen-lower":
+		options.Lower = !options.Lower
+	case "gen-upper":
+		options.Upper = !options.Upper
+	case "gen-digits":
+		options.Digits = !options.Digits
+	case "gen-symbols":
+		options.Symbols = !options.Symbols
+	case "gen-ambiguous":
+		options.ExcludeAmbiguous = !options.ExcludeAmbiguous
+	case "gen-mode":
+		options.Passphrase = !options.Passphrase
+	}
+
+	user.UpdateGenOptions(options)
+
+	// Switching off the last character class is the only way to get an
+	// error here, keep the previous options then.
+	if err := c.sendGenerated(user, chatId); err != nil {
+		user.UpdateGenOptions(previous)
+		_ = c.sendGenerated(user, chatId)
+	}
+}
+
+// sendGenerated generates a password with the user's options and sends it
+// with the generator keyboard.
+func (c *client) sendGenerated(user *UserState, chatId int64) error {
+	password, err := c.botSvc.GeneratePassword(user.GenOptions)
+	if err != nil {
+		return err
+	}
+
+	user.UpdateGenerated(password)
+	c.messageSvc.SendGeneratedPassword(chatId, password, user.GenOptions)
+
+	return nil
+}
+
+func (c *client) isAdmin(chatId int64) bool {
+	for _, id := range c.adminIds {
+		if id == chatId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// askPin asks for the pin, with the notice about creating one if the user
+// doesn't have a vault yet.
+func (c *client) askPin(chatId int64) {
+	hasVault, err := c.botSvc.HasVault(chatId)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+
+	c.messageSvc.AskPin(chatId, !hasVault)
+}
+
+// handlePinError tells the user about a failed pin step. A wrong pin can be
+// retried until maxPinAttempts is reached.
+func (c *client) handlePinError(err error, user *UserState, chatId int64) {
+	if !errors.Is(err, crypto.ErrWrongPin) {
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+
+	user.IncPinAttempts()
+
+	attemptsLeft := maxPinAttempts - user.PinAttempts
+	c.messageSvc.SendWrongPin(chatId, attemptsLeft)
+
+	if attemptsLeft == 0 {
+		user.Refresh()
+	}
+}
+
+// handleRecoveryCodeError works like handlePinError for the recovery code
+// step of /recover.
+func (c *client) handleRecoveryCodeError(err error, user *UserState, chatId int64) {
+	if !errors.Is(err, ErrWrongRecoveryCode) {
+		c.messageSvc.SendWrongMessage(chatId)
+		user.Refresh()
+		return
+	}
+
+	user.IncPinAttempts()
+
+	attemptsLeft := maxPinAttempts - user.PinAttempts
+	c.messageSvc.SendWrongRecoveryCode(chatId, attemptsLeft)
+
+	if attemptsLeft == 0 {
+		user.Refresh()
+	}
+}
+
+// offerRecoveryCodes asks a user who just created the vault whether they
+// want recovery codes, the command goes on with next afterwards.
+func (c *client) offerRecoveryCodes(user *UserState, chatId int64, next string) {
+	user.UpdateNext(next)
+	user.UpdateState("recovery-offer")
+
+	c.messageSvc.AskCreateRecoveryCodes(chatId)
+}
+
+func (c *client) continueAfterRecoveryOffer(user *UserState, chatId int64) {
+	user.UpdateState(user.Next)
+	user.UpdateNext("")
+
+	switch user.State {
+	case "login":
+		c.askFirstField(user, chatId)
+	case "otp-secret":
+		c.messageSvc.AskOtpSecret(chatId)
+	case "attach-file":
+		c.messageSvc.AskAttachment(chatId)
+	}
+}
+
+// sendRecoveryCodes creates new recovery codes with user.Pin and shows
+// them once, they replace any codes the user had before.
+func (c *client) sendRecoveryCodes(user *UserState, chatId int64) error {
+	codes, err := c.botSvc.GenerateRecoveryCodes(chatId, user.Pin)
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	text.WriteString("🔑 Your recovery codes, each of them works once with /recover:\n\n")
+	for i := range codes {
+		code := codes[i].Bytes()
+		fmt.Fprintf(&text, "%s-%s-%s-%s\n", code[0:4], code[4:8], code[8:12], code[12:16])
+		codes[i].Wipe()
+	}
+	text.WriteString("\nWrite them down and keep them somewhere safe, they are not shown again.")
+
+	c.sendSelfDestructing(chatId, text.String(), 2*time.Minute)
+
+	return nil
+}
+
+// sendSharesToTrustees splits the vault key and sends one share to every
+// trustee. Shares that can't be delivered go to the owner instead, so the
+// split stays complete.
+func (c *client) sendSharesToTrustees(user *UserState, chatId int64, trustees []int64, owner string) {
+	shareSet, shares, err := c.botSvc.SplitVaultKey(chatId, user.Pin, user.ShareCount, user.ShareThreshold)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+	defer wipeAll(shares)
+
+	var failed []int64
+	undelivered := make(map[int]bool)
+	for i, trustee := range trustees {
+		if _, err := c.messageSvc.SendShare(trustee, i+1, shareSet, owner, shares[i]); err != nil {
+			c.logger.Infof("failed to send share to %d: %s", trustee, err)
+			failed = append(failed, trustee)
+			undelivered[i] = true
+		}
+	}
+
+	if len(failed) > 0 {
+		c.sendOwnShares(chatId, shareSet, shares, func(i int) bool { return undelivered[i] })
+	}
+
+	c.messageSvc.SendSharesDelivered(chatId, len(trustees)-len(failed), failed)
+}
+
+// sendOwnShares sends the shares picked by include to the owner as files
+// and deletes them after 5 minutes, enough to save them elsewhere. A share
+// that fails to send is reported, the others are still sent.
+func (c *client) sendOwnShares(chatId int64, shareSet *ShareSet, shares []secret.Secret, include func(i int) bool) {
+	var messageIds []int
+	for i, share := range shares {
+		if !include(i) {
+			continue
+		}
+
+		msg, err := c.messageSvc.SendShare(chatId, i+1, shareSet, "", share)
+		if err != nil {
+			c.logger.Errorf("failed to send share %d of %d: %s", i+1, shareSet.Count, err)
+			c.messageSvc.SendShareFailed(chatId, i+1, shareSet)
+			continue
+		}
+		messageIds = append(messageIds, msg.MessageID)
+	}
+
+	go func(chatId int64, messageIds []int) {
+		time.Sleep(5 * time.Minute)
+		for _, messageId := range messageIds {
+			c.messageSvc.DeleteMessage(chatId, messageId)
+		}
+	}(chatId, messageIds)
+}
+
+// entryHTML lays out the fields of entry that are set, one per line, as
+// Telegram HTML. Hidden custom fields are masked. The content of a note
+// goes into a monospace block, so its line breaks and spacing show as they
+// were entered.
+func entryHTML(entry *Entry) string {
+	var text strings.Builder
+
+	icon := "🔐"
+	if entry.Type == entryTypeNote {
+		icon = "📝"
+	}
+	fmt.Fprintf(&text, "%s %s\n", icon, html.EscapeString(entry.Name))
+
+	if folder := folderText(entry.Folder, entry.Tags); folder != "" {
+		fmt.Fprintf(&text, "📁 %s\n", html.EscapeString(folder))
+	}
+
+	if !entry.Content.IsEmpty() {
+		fmt.Fprintf(&text, "<pre>%s</pre>\n", html.EscapeString(string(entry.Content.Bytes())))
+	}
+
+	for _, field := range []struct {
+		label string
+		value secret.Secret
+	}{
+		{"Login", entry.Login},
+		{"Password", entry.Password},
+		{"URL", entry.URL},
+		{"Notes", entry.Notes},
+	} {
+		if !field.value.IsEmpty() {
+			fmt.Fprintf(&text, "%s: %s\n", field.label, html.EscapeString(string(field.value.Bytes())))
+		}
+	}
+
+	for _, field := range entry.Fields {
+		value := "••••••"
+		if !field.Hidden {
+			value = html.EscapeString(string(field.Value.Bytes()))
+		}
+
+		fmt.Fprintf(&text, "%s: %s\n", html.EscapeString(field.Name), value)
+	}
+
+	return text.String()
+}
+
+// sendEntry reveals entry between head and tail, which are HTML as well.
+// A note too long for one message follows the rest of the entry in
+// messages of its own.
+func (c *client) sendEntry(chatId int64, head string, entry *Entry, tail string) {
+	text := head + entryHTML(entry) + tail
+	if visibleLength(text) <= maxRevealLength {
+		c.sendSelfDestructingHTML(chatId, text, 10*time.Second)
+		return
+	}
+
+	rest := *entry
+	rest.Content = secret.Secret{}
+
+	c.sendSelfDestructingHTML(chatId, head+entryHTML(&rest)+tail, 10*time.Second)
+	c.sendSelfDestructingPre(chatId, string(entry.Content.Bytes()), 10*time.Second)
+}
+
+// usageText sums up the usage of entry, like "Created 2025-03-01, last used
+// 3 days ago, revealed 14 times."
+func usageText(entry *Entry, now time.Time) string {
+	created := fmt.Sprintf("Created %s", entry.CreatedAt.UTC().Format("2006-01-02"))
+	if entry.AccessedAt == nil {
+		return created + ", no reveals recorded yet."
+	}
+
+	return fmt.Sprintf("%s, last used %s, revealed %s.", created, timeAgo(now.Sub(*entry.AccessedAt)), plural(entry.AccessCount, "time"))
+}
+
+// timeAgo rounds d down to the largest whole unit.
+func timeAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int64(d/time.Minute), "minute") + " ago"
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour") + " ago"
+	default:
+		return plural(int64(d/(24*time.Hour)), "day") + " ago"
+	}
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// visibleLength counts text the way Telegram does against its message
+// limit: in UTF-16 code units, without the HTML markup.
+func visibleLength(text string) int {
+	return len(utf16.Encode([]rune(html.UnescapeString(htmlTag.ReplaceAllString(text, "")))))
+}
+
+// splitText cuts text into pieces of at most size UTF-16 code units. A
+// piece ends after a line break if there is one in its second half.
+func splitText(text string, size int) []string {
+	var pieces []string
+	for text != "" {
+		end, units, lineEnd := 0, 0, 0
+		for end < len(text) {
+			r, width := utf8.DecodeRuneInString(text[end:])
+
+			n := 1
+			if r >= 0x10000 {
+				n = 2
+			}
+			if units+n > size {
+				break
+			}
+
+			units += n
+			end += width
+			if r == '\n' {
+				lineEnd = end
+			}
+		}
+
+		if end < len(text) && lineEnd > end/2 {
+			end = lineEnd
+		}
+
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+
+	return pieces
+}
+
+// cloneFields copies fields, values included, so the copy can be wiped on
+// its own.
+func cloneFields(fields []CustomField) []CustomField {
+	if fields == nil {
+		return nil
+	}
+
+	clones := make([]CustomField, len(fields))
+	for i, field := range fields {
+		clones[i] = CustomField{Name: field.Name, Value: field.Value.Clone(), Hidden: field.Hidden}
+	}
+
+	return clones
+}
+
+// parseTrustees reads count distinct Telegram user ids separated by spaces
+// or commas.
+func parseTrustees(text string, count int) ([]int64, bool) {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	if len(fields) != count {
+		return nil, false
+	}
+
+	trustees := make([]int64, 0, count)
+	seen := make(map[int64]bool)
+	for _, field := range fields {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || id <= 0 || seen[id] {
+			return nil, false
+		}
+
+		seen[id] = true
+		trustees = append(trustees, id)
+	}
+
+	return trustees, true
+}
+
+// displayName names a user to the people they send shares to.
+func displayName(from *tgbotapi.User) string {
+	if from == nil {
+		return "Someone"
+	}
+
+	if from.UserName != "" {
+		return "@" + from.UserName
+	}
+
+	return strings.TrimSpace(from.FirstName + " " + from.LastName)
+}
+
+func (c *client) handlePagination(data string, user *UserState, chatId int64) {
+	switch data {
+	case "next":
+		user.IncPage()
+	case "prev":
 		user.DecPage()
+	default:
+		return
+	}
 
-		userDataNameChunks, err := c.botSvc.GetUserDataNamesByChunks(chatId, user.Page)
+	if user.State == "otp" {
+		nameChunks, err := c.botSvc.GetUserOtpNamesByChunks(chatId, user.Page)
 		if err != nil {
 			c.messageSvc.SendWrongMessage(chatId)
 			return
 		}
 
-		c.messageSvc.AskWhatDecrypt(chatId, userDataNameChunks)
+		c.messageSvc.AskWhatOtp(chatId, nameChunks)
+		return
+	}
+
+	c.resendEntryPicker(user, chatId)
+}
+
+// handleEntryPicker handles the picker buttons that don't pick an entry:
+// pagination, a folder or tag, and back to them. It reports whether data
+// was one of those.
+func (c *client) handleEntryPicker(data string, user *UserState, chatId int64) bool {
+	var i int
+	switch {
+	case data == "next" || data == "prev":
+		c.handlePagination(data, user, chatId)
+		return true
+	case data == "groups":
+		user.UpdateGroup(nil)
+	case strings.HasPrefix(data, "group-"):
+		if _, err := fmt.Sscanf(data, "group-%d", &i); err != nil || i < 0 || i >= len(user.Groups) {
+			return true
+		}
+
+		user.UpdateGroup(&user.Groups[i])
+	default:
+		return false
+	}
+
+	c.resendEntryPicker(user, chatId)
+
+	return true
+}
+
+func (c *client) resendEntryPicker(user *UserState, chatId int64) {
+	ok, err := c.sendEntryPicker(user, chatId)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+
+	if !ok {
+		c.messageSvc.SendDoNotHaveData(chatId)
+	}
+}
+
+// sendEntryPicker shows the current page of the picker of /dec, /upd, /del,
+// /history, /attach, /fav or /info: the folders and tags if the user has any, then the entries
+// of the one picked. It reports false if there is nothing to pick.
+func (c *client) sendEntryPicker(user *UserState, chatId int64) (bool, error) {
+	if user.Group == nil {
+		groups, err := c.botSvc.GetEntryGroups(chatId)
+		if err != nil {
+			return false, err
+		}
+
+		user.UpdateGroups(groups)
+
+		if len(groups) > 0 {
+			c.messageSvc.AskWhichGroup(chatId, groupChunks(groups, user.Page))
+			return true, nil
+		}
+	}
+
+	nameChunks, err := c.botSvc.GetUserDataNamesByChunks(chatId, user.Group, user.Page)
+	if err != nil {
+		return false, err
+	}
+
+	if nameChunks == nil {
+		return false, nil
+	}
+
+	if user.Group != nil {
+		nameChunks = append(nameChunks, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬅️ Folders and tags", "groups"),
+		))
+	}
+
+	switch user.State {
+	case "update":
+		c.messageSvc.AskWhatUpdate(chatId, nameChunks)
+	case "delete":
+		c.messageSvc.AskWhatDelete(chatId, nameChunks)
+	case "history":
+		c.messageSvc.AskWhatHistory(chatId, nameChunks)
+	case "attach":
+		c.messageSvc.AskWhatAttach(chatId, nameChunks)
+	case "favorite":
+		c.messageSvc.AskWhatFavorite(chatId, nameChunks)
+	case "info":
+		c.messageSvc.AskWhatInfo(chatId, nameChunks)
+	default:
+		c.messageSvc.AskWhatDecrypt(chatId, nameChunks)
+	}
+
+	return true, nil
+}
+
+// sendEntryDetails shows when the entry picked in user was created and
+// used, no pin is needed for that.
+func (c *client) sendEntryDetails(user *UserState, chatId int64) {
+	details, err := c.botSvc.GetEntryDetails(chatId, user.EntryId)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		user.Refresh()
+		return
+	}
+
+	c.messageSvc.SendEntryDetails(chatId, details)
+
+	user.Refresh()
+}
+
+// askReveal offers the hidden fields and the attachments of entry once it
+// is shown, if it has any. The pin isn't kept while they are offered, a
+// pick asks for it again.
+func (c *client) askReveal(user *UserState, chatId int64, entry *Entry) {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, field := range entry.Fields {
+		if field.Hidden {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("👁 Show "+field.Name, fmt.Sprintf("field-%d", i))))
+		}
+	}
+
+	attachments, err := c.botSvc.GetAttachmentButtons(chatId, user.Pin, user.EntryId)
+	if err != nil {
+		c.messageSvc.SendWrongMessage(chatId)
+		user.Refresh()
+		return
+	}
+	rows = append(rows, attachments...)
+
+	if len(rows) == 0 {
+		user.Refresh()
+		return
+	}
+
+	user.Pin.Wipe()
+	user.UpdateState("reveal")
+	c.messageSvc.AskWhatReveal(chatId, rows)
+}
+
+// handleReveal shows the hidden field or sends the attachment picked from
+// askReveal once the pin is entered, then offers them again.
+func (c *client) handleReveal(user *UserState, chatId int64) {
+	// The decryption that offered the reveal was already recorded.
+	entry, err := c.botSvc.PeekEntry(chatId, user.Pin, user.EntryId)
+	if err != nil {
+		c.handlePinError(err, user, chatId)
+		return
+	}
+	defer entry.Wipe()
+
+	data := user.Reveal
+
+	var i int
+	switch {
+	case strings.HasPrefix(data, "field-"):
+		if _, err := fmt.Sscanf(data, "field-%d", &i); err != nil || i < 0 || i >= len(entry.Fields) {
+			user.Refresh()
+			return
+		}
+
+		field := entry.Fields[i]
+		text := fmt.Sprintf("%s: %s", html.EscapeString(field.Name), html.EscapeString(string(field.Value.Bytes())))
+		if visibleLength(text) > maxRevealLength {
+			c.sendSelfDestructingHTML(chatId, html.EscapeString(field.Name)+":", 10*time.Second)
+			c.sendSelfDestructingPre(chatId, string(field.Value.Bytes()), 10*time.Second)
+			break
+		}
+
+		c.sendSelfDestructingHTML(chatId, text, 10*time.Second)
+	case strings.HasPrefix(data, "attachment-"):
+		id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(data, "attachment-"))
+		if err != nil {
+			user.Refresh()
+			return
+		}
+
+		go c.sendAttachment(chatId, user.Pin.Clone(), id)
+	default:
+		user.Refresh()
+		return
+	}
+
+	c.askReveal(user, chatId, entry)
+}
+
+// saveAttachment downloads document and attaches it to the entry,
+// encrypted on the way to the database. It runs off the update loop and
+// wipes pin when done.
+func (c *client) saveAttachment(chatId int64, pin secret.Secret, entryId primitive.ObjectID, document tgbotapi.Document) {
+	defer pin.Wipe()
+
+	name := document.FileName
+	if name == "" {
+		name = "attachment"
+	}
+
+	content, err := c.messageSvc.OpenFile(document.FileID, maxAttachmentSize)
+	if err == nil {
+		err = c.botSvc.SaveAttachment(chatId, pin, entryId, name, content)
+		content.Close()
+	}
+
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		c.messageSvc.SendAttachmentTooLarge(chatId)
+	case err != nil:
+		c.logger.Errorf("failed to attach file: %s", err)
+		c.messageSvc.SendWrongMessage(chatId)
+	default:
+		c.messageSvc.SendAttachmentSaved(chatId)
 	}
 }
+
+// sendAttachment decrypts the attachment while it is uploaded to the chat
+// and deletes it after a minute. It runs off the update loop and wipes pin
+// when done.
+func (c *client) sendAttachment(chatId int64, pin secret.Secret, id primitive.ObjectID) {
+	defer pin.Wipe()
+
+	name, content, err := c.botSvc.OpenAttachment(chatId, pin, id)
+	if err != nil {
+		c.logger.Errorf("failed to open attachment: %s", err)
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+	defer content.Close()
+
+	lifetime := time.Minute
+	msg, err := c.messageSvc.SendAttachment(chatId, name, content, lifetime)
+	if err != nil {
+		c.logger.Errorf("failed to send attachment: %s", err)
+		c.messageSvc.SendWrongMessage(chatId)
+		return
+	}
+
+	time.Sleep(lifetime)
+	c.messageSvc.DeleteMessage(chatId, msg.MessageID)
+}
+
+// sendSelfDestructing sends text with a notice and deletes it after
+// lifetime, for anything secret that shouldn't stay in the chat.
+func (c *client) sendSelfDestructing(chatId int64, text string, lifetime time.Duration) {
+	c.sendSelfDestructingMessage(tgbotapi.NewMessage(chatId, text), lifetime)
+}
+
+// sendSelfDestructingHTML works like sendSelfDestructing for text in
+// Telegram HTML.
+func (c *client) sendSelfDestructingHTML(chatId int64, text string, lifetime time.Duration) {
+	message := tgbotapi.NewMessage(chatId, text)
+	message.ParseMode = tgbotapi.ModeHTML
+
+	c.sendSelfDestructingMessage(message, lifetime)
+}
+
+// sendSelfDestructingPre sends text in monospace blocks, split over as
+// many messages as it takes.
+func (c *client) sendSelfDestructingPre(chatId int64, text string, lifetime time.Duration) {
+	for _, piece := range splitText(text, maxRevealLength) {
+		c.sendSelfDestructingHTML(chatId, "<pre>"+html.EscapeString(piece)+"</pre>", lifetime)
+	}
+}
+
+func (c *client) sendSelfDestructingMessage(message tgbotapi.MessageConfig, lifetime time.Duration) {
+	message.Text = fmt.Sprintf("🟠 NOTICE: This message will be delete in %d seconds. \n%s", int(lifetime.Seconds()), message.Text)
+	msg := c.messageSvc.SendManualMessage(message)
+
+	go func(chatId int64, messageId int) {
+		time.Sleep(lifetime)
+		c.messageSvc.DeleteMessage(chatId, messageId)
+		c.messageSvc.SendManualMessage(tgbotapi.NewMessage(chatId, "Thanks for using.😌"))
+	}(message.ChatID, msg.MessageID)
+}
@@ -0,0 +1,362 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"password-guard-bot/pkg/secret"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Entry is one stored login or secure note. The name, the type, the folder,
+// the tags, the usage and the timestamps stay in the clear to list entries,
+// the other fields are encrypted together as one payload.
+type Entry struct {
+	ID          primitive.ObjectID
+	Name        string
+	Type        string
+	Folder      string
+	Tags        []string
+	Login       secret.Secret
+	Password    secret.Secret
+	URL         secret.Secret
+	Notes       secret.Secret
+	Content     secret.Secret
+	Fields      []CustomField
+	AccessedAt  *time.Time
+	AccessCount int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// CustomField is a named field added to a login, like a security question
+// or an account number. A hidden field is only shown when asked for.
+type CustomField struct {
+	Name   string
+	Value  secret.Secret
+	Hidden bool
+}
+
+// EntryRecord is an Entry as stored in the entries collection, Payload is
+// sealed and encrypted. History holds the payloads it replaced, newest
+// first. AccessedAt and AccessCount track decryptions, to sort by use.
+type EntryRecord struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	TelegramId  int64              `bson:"telegram_id"`
+	Name        string             `bson:"name"`
+	Type        string             `bson:"type,omitempty"`
+	Folder      string             `bson:"folder,omitempty"`
+	Tags        []string           `bson:"tags,omitempty"`
+	Favorite    bool               `bson:"favorite,omitempty"`
+	Payload     string             `bson:"payload"`
+	Format      int                `bson:"format"`
+	History     []EntryVersion     `bson:"history,omitempty"`
+	AccessedAt  *time.Time         `bson:"accessed_at,omitempty"`
+	AccessCount int64              `bson:"access_count,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
+
+// EntryVersion is an earlier payload of an entry, UpdatedAt is when it was
+// saved. Type is the type of the payload, a login may have become a note.
+type EntryVersion struct {
+	Type      string    `bson:"type,omitempty"`
+	Payload   string    `bson:"payload"`
+	Format    int       `bson:"format"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+const (
+	entryTypeLogin = ""
+	// entryTypeNote only has Content, kept exactly as it was entered.
+	entryTypeNote = "note"
+	// entryTypeOtp only has Content, the otpauth:// URI or base32 secret of
+	// a one-time code. It is listed by /otp instead of the entry pickers.
+	entryTypeOtp = "otp"
+)
+
+// Orders of the entry pickers, picked with /settings. Favorites always come
+// first, entries that are equal otherwise are sorted by name.
+const (
+	entryOrderName     = ""
+	entryOrderRecent   = "recent"
+	entryOrderFrequent = "frequent"
+)
+
+const (
+	// entryFormatLegacy is the "login:password" string of the old data
+	// map, it is rewritten the first time the entry is decrypted.
+	entryFormatLegacy = 0
+	entryFormatFields = 1
+	// entryFormatSecret is the bare secret of the old otp map, it is
+	// rewritten the first time the entry is decrypted.
+	entryFormatSecret = 2
+)
+
+// Field tags of entryFormatFields. Unknown tags are skipped, so fields can
+// be added without a new format.
+const (
+	entryTagLogin    byte = 1
+	entryTagPassword byte = 2
+	entryTagURL      byte = 3
+	entryTagNotes    byte = 4
+	entryTagContent  byte = 5
+	// A custom field is the length of its name, the name and the value.
+	entryTagField       byte = 6
+	entryTagHiddenField byte = 7
+)
+
+var (
+	errInvalidEntry   = errors.New("invalid entry payload")
+	errUnknownVersion = errors.New("unknown entry version")
+	errNotOtp         = errors.New("entry is not a one-time code secret")
+)
+
+// label is the name of the entry in pickers.
+func (r *EntryRecord) label() string {
+	label := r.Name
+	if r.Type == entryTypeNote {
+		label = "📝 " + label
+	}
+	if r.Favorite {
+		label = "⭐ " + label
+	}
+
+	return label
+}
+
+// EntryGroup is a folder, a tag or the favorites to pick entries from. With
+// none set it holds the entries without a folder.
+type EntryGroup struct {
+	Folder    string
+	Tag       string
+	Favorites bool
+}
+
+func (g EntryGroup) Label() string {
+	switch {
+	case g.Favorites:
+		return "⭐ Favorites"
+	case g.Tag != "":
+		return "🏷 #" + g.Tag
+	case g.Folder != "":
+		return "📁 " + g.Folder
+	default:
+		return "📂 No folder"
+	}
+}
+
+// parseFolder reads a folder path and tags from text like
+// "work / mail #email #2fa". Words starting with # are tags, the rest is
+// the path.
+func parseFolder(text string) (string, []string) {
+	var path, tags []string
+	for _, word := range strings.Fields(text) {
+		if tag := strings.TrimLeft(word, "#"); tag != word {
+			if tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+			continue
+		}
+
+		path = append(path, word)
+	}
+
+	var folder []string
+	for _, part := range strings.Split(strings.Join(path, " "), "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			folder = append(folder, part)
+		}
+	}
+
+	return strings.Join(folder, "/"), tags
+}
+
+// folderText writes a folder and tags the way parseFolder reads them.
+func folderText(folder string, tags []string) string {
+	words := make([]string, 0, len(tags)+1)
+	if folder != "" {
+		words = append(words, folder)
+	}
+	for _, tag := range tags {
+		words = append(words, "#"+tag)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// details returns the entry with only the fields stored in the clear.
+func (r *EntryRecord) details() *Entry {
+	return &Entry{
+		ID:          r.ID,
+		Name:        r.Name,
+		Type:        r.Type,
+		Folder:      r.Folder,
+		Tags:        r.Tags,
+		AccessedAt:  r.AccessedAt,
+		AccessCount: r.AccessCount,
+		CreatedAt:   r.CreatedAt,
+		UpdatedAt:   r.UpdatedAt,
+	}
+}
+
+// pushVersion moves the current payload to the front of the history, which
+// keeps at most depth versions.
+func (r *EntryRecord) pushVersion(depth int) {
+	r.History = append([]EntryVersion{{Type: r.Type, Payload: r.Payload, Format: r.Format, UpdatedAt: r.UpdatedAt}}, r.History...)
+	if len(r.History) > depth {
+		r.History = r.History[:depth]
+	}
+}
+
+// version returns the record as it was at version i of the history. The
+// folder and tags only sort the entry, they aren't versioned and a version
+// keeps the current ones.
+func (r *EntryRecord) version(i int) (*EntryRecord, error) {
+	if i < 0 || i >= len(r.History) {
+		return nil, errUnknownVersion
+	}
+
+	return &EntryRecord{
+		ID:         r.ID,
+		TelegramId: r.TelegramId,
+		Name:       r.Name,
+		Type:       r.History[i].Type,
+		Folder:     r.Folder,
+		Tags:       r.Tags,
+		Payload:    r.History[i].Payload,
+		Format:     r.History[i].Format,
+		CreatedAt:  r.CreatedAt,
+		UpdatedAt:  r.History[i].UpdatedAt,
+	}, nil
+}
+
+func (e *Entry) Wipe() {
+	e.Login.Wipe()
+	e.Password.Wipe()
+	e.URL.Wipe()
+	e.Notes.Wipe()
+	e.Content.Wipe()
+	for i := range e.Fields {
+		e.Fields[i].Value.Wipe()
+	}
+}
+
+// marshal encodes the encrypted fields as tag, length and value. The
+// result is built in one buffer of the final size, unlike JSON, so wiping
+// it leaves no copy of the fields behind.
+func (e *Entry) marshal() secret.Secret {
+	fields := []struct {
+		tag   byte
+		value secret.Secret
+	}{
+		{entryTagLogin, e.Login},
+		{entryTagPassword, e.Password},
+		{entryTagURL, e.URL},
+		{entryTagNotes, e.Notes},
+		{entryTagContent, e.Content},
+	}
+
+	size := 0
+	for _, field := range fields {
+		if !field.value.IsEmpty() {
+			size += 1 + binary.MaxVarintLen64 + field.value.Len()
+		}
+	}
+
+	for _, field := range e.Fields {
+		size += 1 + 2*binary.MaxVarintLen64 + len(field.Name) + field.Value.Len()
+	}
+
+	payload := make([]byte, 0, size)
+	for _, field := range fields {
+		if field.value.IsEmpty() {
+			continue
+		}
+
+		payload = append(payload, field.tag)
+		payload = binary.AppendUvarint(payload, uint64(field.value.Len()))
+		payload = append(payload, field.value.Bytes()...)
+	}
+
+	for _, field := range e.Fields {
+		tag := entryTagField
+		if field.Hidden {
+			tag = entryTagHiddenField
+		}
+
+		nameLength := binary.AppendUvarint(nil, uint64(len(field.Name)))
+
+		payload = append(payload, tag)
+		payload = binary.AppendUvarint(payload, uint64(len(nameLength)+len(field.Name)+field.Value.Len()))
+		payload = append(payload, nameLength...)
+		payload = append(payload, field.Name...)
+		payload = append(payload, field.Value.Bytes()...)
+	}
+
+	return secret.FromBytes(payload)
+}
+
+// decodeEntry reads the decrypted payload of record. The fields are copied,
+// plaintext can be wiped afterwards.
+func decodeEntry(record *EntryRecord, plaintext []byte) (*Entry, error) {
+	entry := record.details()
+
+	switch record.Format {
+	case entryFormatLegacy:
+		// A colon in the login can't be told apart from one in the
+		// password, the first one is the best guess.
+		login, password, _ := bytes.Cut(plaintext, []byte(":"))
+		entry.Login = secret.FromBytes(bytes.Clone(login))
+		entry.Password = secret.FromBytes(bytes.Clone(password))
+	case entryFormatFields:
+		for len(plaintext) > 0 {
+			tag := plaintext[0]
+
+			length, n := binary.Uvarint(plaintext[1:])
+			if n <= 0 || length > uint64(len(plaintext)-1-n) {
+				entry.Wipe()
+				return nil, errInvalidEntry
+			}
+
+			value := plaintext[1+n : 1+n+int(length)]
+			plaintext = plaintext[1+n+int(length):]
+
+			switch tag {
+			case entryTagLogin:
+				entry.Login = secret.FromBytes(bytes.Clone(value))
+			case entryTagPassword:
+				entry.Password = secret.FromBytes(bytes.Clone(value))
+			case entryTagURL:
+				entry.URL = secret.FromBytes(bytes.Clone(value))
+			case entryTagNotes:
+				entry.Notes = secret.FromBytes(bytes.Clone(value))
+			case entryTagContent:
+				entry.Content = secret.FromBytes(bytes.Clone(value))
+			case entryTagField, entryTagHiddenField:
+				nameLength, n := binary.Uvarint(value)
+				if n <= 0 || nameLength > uint64(len(value)-n) {
+					entry.Wipe()
+					return nil, errInvalidEntry
+				}
+
+				entry.Fields = append(entry.Fields, CustomField{
+					Name:   string(value[n : n+int(nameLength)]),
+					Value:  secret.FromBytes(bytes.Clone(value[n+int(nameLength):])),
+					Hidden: tag == entryTagHiddenField,
+				})
+			}
+		}
+	case entryFormatSecret:
+		entry.Content = secret.FromBytes(bytes.Clone(plaintext))
+	default:
+		return nil, fmt.Errorf("unknown entry format %d", record.Format)
+	}
+
+	return entry, nil
+}
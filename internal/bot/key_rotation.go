@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	RotationRunning = "running"
+	RotationDone    = "done"
+)
+
+// KeyRotation tracks moving all stored data from one pepper key to another.
+// The worker walks users in _id order and saves LastUserId after each one,
+// so a restarted bot continues where it stopped. A pass that changes
+// nothing finishes the rotation, unless it met values it can't open or
+// some are still sealed with the old key. Unreadable is the number of
+// values the last finished pass couldn't open.
+type KeyRotation struct {
+	ID             primitive.ObjectID `bson:"_id"`
+	FromKeyId      string             `bson:"from_key_id"`
+	FromKeyFile    string             `bson:"from_key_file"`
+	ToKeyId        string             `bson:"to_key_id"`
+	ToKeyFile      string             `bson:"to_key_file"`
+	Status         string             `bson:"status"`
+	Pass           int                `bson:"pass"`
+	LastUserId     primitive.ObjectID `bson:"last_user_id"`
+	Processed      int64              `bson:"processed"`
+	Resealed       int64              `bson:"resealed"`
+	PassChanged    int64              `bson:"pass_changed"`
+	PassUnreadable int64              `bson:"pass_unreadable"`
+	Unreadable     int64              `bson:"unreadable"`
+	Total          int64              `bson:"total"`
+	StartedAt      time.Time          `bson:"started_at"`
+	UpdatedAt      time.Time          `bson:"updated_at"`
+	FinishedAt     *time.Time         `bson:"finished_at"`
+}
+
+func NewKeyRotation(fromKeyId, fromKeyFile, toKeyId, toKeyFile string) (*KeyRotation, error) {
+	if fromKeyId == "" || toKeyId == "" {
+		return nil, errors.New("invalid pepper key id")
+	}
+	if toKeyFile == "" {
+		return nil, errors.New("invalid pepper key file")
+	}
+
+	now := time.Now()
+
+	return &KeyRotation{
+		ID:          primitive.NewObjectID(),
+		FromKeyId:   fromKeyId,
+		FromKeyFile: fromKeyFile,
+		ToKeyId:     toKeyId,
+		ToKeyFile:   toKeyFile,
+		Status:      RotationRunning,
+		Pass:        1,
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}, nil
+}
+
+// Checkpoint records that the user with id was processed, with unreadable
+// values left on the old key.
+func (r *KeyRotation) Checkpoint(id primitive.ObjectID, changed bool, unreadable int64) {
+	r.LastUserId = id
+	r.Processed += 1
+	if changed {
+		r.Resealed += 1
+		r.PassChanged += 1
+	}
+	r.PassUnreadable += unreadable
+	r.UpdatedAt = time.Now()
+}
+
+// NextPass starts another walk over all users.
+func (r *KeyRotation) NextPass(total int64) {
+	r.Pass += 1
+	r.LastUserId = primitive.NilObjectID
+	r.Processed = 0
+	r.PassChanged = 0
+	r.Unreadable = r.PassUnreadable
+	r.PassUnreadable = 0
+	r.Total = total
+	r.UpdatedAt = time.Now()
+}
+
+func (r *KeyRotation) Finish() {
+	now := time.Now()
+
+	r.Status = RotationDone
+	r.UpdatedAt = now
+	r.FinishedAt = &now
+}
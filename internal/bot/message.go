@@ -2,6 +2,16 @@ package bot
 
 import (
 	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"password-guard-bot/pkg/generator"
+	"password-guard-bot/pkg/secret"
+	"password-guard-bot/pkg/strength"
+	"strconv"
+	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go.uber.org/zap"
@@ -13,26 +23,95 @@ type MessageService interface {
 
 	SendWelcomeMessage(chatId int64)
 	SendStartEncryptProcess(chatId int64)
+	SendStartNoteProcess(chatId int64)
 	SendWrongMessage(chatId int64)
+	SendWrongPin(chatId int64, attemptsLeft int)
 	SendIncorrectCommand(chatId int64)
 	SendSuccessMessage(chatId int64)
 	SendAlreadyHaveNameWithKeyboard(chatId int64)
 	SendDoNotHaveData(chatId int64)
 	SendUpdateWhatExactly(chatId int64)
 	SendSuccessDelete(chatId int64)
+	SendNoPin(chatId int64)
+	SendPinMismatch(chatId int64)
+	SendPinChanged(chatId int64)
+	SendEntriesSkipped(chatId int64, count int)
+	SendKeyRotationStatus(chatId int64, rotation *KeyRotation)
+	SendKeyRotationFailed(chatId int64, err error)
+	SendNoKeyRotation(chatId int64)
+	SendGeneratedPassword(chatId int64, password string, options generator.Options)
+	SendPasswordWarning(chatId int64, result strength.Result, breaches int)
+	SendOtpAdded(chatId int64)
+	SendInvalidOtpSecret(chatId int64)
+	SendAlreadyHaveOtpName(chatId int64)
+	SendWrongRecoveryCode(chatId int64, attemptsLeft int)
+	SendNoRecoveryCodes(chatId int64)
+	SendVaultRecovered(chatId int64, codesLeft int)
+	SendShare(chatId int64, number int, shares *ShareSet, from string, share secret.Secret) (tgbotapi.Message, error)
+	SendShareFailed(chatId int64, number int, shares *ShareSet)
+	SendSharesCreated(chatId int64, threshold, count int)
+	SendSharesDelivered(chatId int64, delivered int, failed []int64)
+	SendInvalidTrustees(chatId int64, count int)
+	SendNoShares(chatId int64)
+	SendInvalidShare(chatId int64)
+	SendWrongShares(chatId int64)
+	SendNoHistory(chatId int64)
+	SendNothingFound(chatId int64, query string)
+	SendVersionRestored(chatId int64)
+	SendFavorite(chatId int64, favorite bool)
+	SendEntryDetails(chatId int64, entry *Entry)
+	SendSettingsSaved(chatId int64)
+	SendAttachmentSaved(chatId int64)
+	SendAttachmentTooLarge(chatId int64)
+	SendAttachment(chatId int64, name string, content io.Reader, lifetime time.Duration) (tgbotapi.Message, error)
+	DownloadFile(fileId string) ([]byte, error)
+	OpenFile(fileId string, limit int64) (io.ReadCloser, error)
 
 	AskPin(chatId int64, register bool)
+	AskCurrentPin(chatId int64)
+	AskNewPin(chatId int64)
+	AskConfirmPin(chatId int64)
 	AskLogin(chatId int64)
 	AskPassword(chatId int64)
+	AskURL(chatId int64)
+	AskNotes(chatId int64)
+	AskNoteContent(chatId int64)
+	AskCustomField(chatId int64, fields []CustomField)
+	AskFieldValue(chatId int64, name string)
+	AskFieldHidden(chatId int64)
+	AskFolder(chatId int64, current string)
 	AskNewNameFromData(chatId int64)
+	AskWhichGroup(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
 	AskWhatDecrypt(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
 	AskWhatUpdate(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
 	AskWhatDelete(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskWhatOtp(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskWhatHistory(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskWhatAttach(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskWhatFavorite(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskWhatInfo(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskEntryOrder(chatId int64, current string)
+	AskAttachment(chatId int64)
+	AskWhatReveal(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskFindQuery(chatId int64)
+	AskWhatFound(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskEntryAction(chatId int64)
+	AskWhichVersion(chatId int64, data [][]tgbotapi.InlineKeyboardButton)
+	AskVersionAction(chatId int64)
+	AskOtpName(chatId int64)
+	AskOtpSecret(chatId int64)
+	AskCreateRecoveryCodes(chatId int64)
+	AskRecoveryCode(chatId int64)
+	AskSharesSize(chatId int64)
+	AskSharesDelivery(chatId int64)
+	AskTrustees(chatId int64, count int)
+	AskShare(chatId int64, needed int)
 }
 
 type messageService struct {
-	botApi *tgbotapi.BotAPI
-	logger *zap.SugaredLogger
+	botApi     *tgbotapi.BotAPI
+	httpClient *http.Client
+	logger     *zap.SugaredLogger
 }
 
 func NewMessageService(botApi *tgbotapi.BotAPI, logger *zap.SugaredLogger) (MessageService, error) {
@@ -43,7 +122,7 @@ func NewMessageService(botApi *tgbotapi.BotAPI, logger *zap.SugaredLogger) (Mess
 		return nil, errors.New("invalid logger")
 	}
 
-	return &messageService{botApi: botApi, logger: logger}, nil
+	return &messageService{botApi: botApi, httpClient: &http.Client{Timeout: fileDownloadTimeout}, logger: logger}, nil
 }
 
 var keyboardReplaceName = tgbotapi.NewInlineKeyboardMarkup(
@@ -61,6 +140,81 @@ var keyboardUpdateWhat = tgbotapi.NewInlineKeyboardMarkup(
 	),
 )
 
+var keyboardSkip = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Skip", "skip"),
+	),
+)
+
+var keyboardWeakPassword = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Keep anyway", "weak-keep"),
+		tgbotapi.NewInlineKeyboardButtonData("🎲 Use generated", "weak-generate"),
+	),
+)
+
+var keyboardRecoveryCodes = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔑 Create codes", "recovery-yes"),
+		tgbotapi.NewInlineKeyboardButtonData("Not now", "recovery-no"),
+	),
+)
+
+var keyboardSharesSize = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("2 of 3", "shares-2-3"),
+		tgbotapi.NewInlineKeyboardButtonData("3 of 5", "shares-3-5"),
+		tgbotapi.NewInlineKeyboardButtonData("4 of 7", "shares-4-7"),
+	),
+)
+
+var keyboardSharesDelivery = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("📄 Send me the files", "shares-documents"),
+		tgbotapi.NewInlineKeyboardButtonData("👥 Send to trusted users", "shares-trusted"),
+	),
+)
+
+var keyboardEntryAction = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔓 Decrypt", "entry-decrypt"),
+		tgbotapi.NewInlineKeyboardButtonData("✏️ Update", "entry-update"),
+		tgbotapi.NewInlineKeyboardButtonData("🗑 Delete", "entry-delete"),
+	),
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("ℹ️ Details", "entry-details"),
+	),
+)
+
+var keyboardFieldHidden = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🙈 Hidden", "field-hidden"),
+		tgbotapi.NewInlineKeyboardButtonData("👁 Visible", "field-visible"),
+	),
+)
+
+var keyboardVersionAction = tgbotapi.NewInlineKeyboardMarkup(
+	tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔓 Show", "version-show"),
+		tgbotapi.NewInlineKeyboardButtonData("↩️ Restore", "version-restore"),
+	),
+)
+
+// maxDownloadSize is far above any share document, anything bigger is not
+// one.
+const maxDownloadSize = 64 << 10
+
+// maxAttachmentSize is the largest file the Bot API lets a bot download.
+const maxAttachmentSize = 20 << 20
+
+// fileDownloadTimeout bounds a whole download, body included. It leaves a
+// slow connection enough time for maxAttachmentSize.
+const fileDownloadTimeout = 5 * time.Minute
+
+// ErrFileTooLarge is returned while reading a file opened with OpenFile
+// once it goes past the limit.
+var ErrFileTooLarge = errors.New("file is too large")
+
 func (s *messageService) SendManualMessage(message tgbotapi.MessageConfig) tgbotapi.Message {
 	msg, err := s.botApi.Send(message)
 
@@ -78,7 +232,7 @@ func (s *messageService) DeleteMessage(chatId int64, messageId int) {
 }
 
 func (s *messageService) SendWelcomeMessage(chatId int64) {
-	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "Hello. It's password guard.\nWe store only your encrypted passwords.\nMain commands:\n/enc - encrypt data\n/dec - decrypt data\n/upd - update data\n/del - delete data")); err != nil {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "Hello. It's password guard.\nWe store only your encrypted passwords.\nMain commands:\n/enc - encrypt data\n/note - encrypt a secure note\n/dec - decrypt data\n/upd - update data\n/del - delete data\n/pin - change pin code\n/gen - generate password\n/otp - one-time codes\n/codes - new recovery codes\n/recover - set a new pin code with a recovery code\n/shares - split access into shares for trusted people\n/recover_shares - set a new pin code with shares\n/history - earlier versions of data\n/find - search data by name\n/attach - attach a file to data\n/fav - add data to favorites or remove it\n/info - when data was created and used\n/settings - choose how data is sorted")); err != nil {
 		s.logger.Panic(err)
 	}
 }
@@ -89,12 +243,29 @@ func (s *messageService) SendStartEncryptProcess(chatId int64) {
 	}
 }
 
+func (s *messageService) SendStartNoteProcess(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "1️⃣ Ok. Let's start. First step enter a name for the note.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
 func (s *messageService) SendWrongMessage(chatId int64) {
 	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ Something wrong. Please try later.")); err != nil {
 		s.logger.Panic(err)
 	}
 }
 
+func (s *messageService) SendWrongPin(chatId int64, attemptsLeft int) {
+	text := fmt.Sprintf("❌ Wrong pin code. Please try again, attempts left: %d.", attemptsLeft)
+	if attemptsLeft == 0 {
+		text = "❌ Wrong pin code. Too many attempts, please start again."
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
 func (s *messageService) SendIncorrectCommand(chatId int64) {
 	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ Incorrect command!")); err != nil {
 		s.logger.Panic(err)
@@ -137,9 +308,411 @@ func (s *messageService) SendSuccessDelete(chatId int64) {
 	}
 }
 
+func (s *messageService) SendNoPin(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 You don't have a pin code yet. It will be created with your first /enc.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendPinMismatch(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ Pin codes don't match.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendPinChanged(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "✅ Success. Your pin code has been changed.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendEntriesSkipped(chatId int64, count int) {
+	text := fmt.Sprintf("🟠 %d of your entries were saved with another pin code before the vault existed. "+
+		"They weren't moved to the new pin code, open them with the pin code they were saved with.", count)
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendKeyRotationStatus(chatId int64, rotation *KeyRotation) {
+	text := fmt.Sprintf("🔑 Key rotation %s → %s is running.\nPass %d: %d/%d users, %d resealed in total.",
+		rotation.FromKeyId, rotation.ToKeyId, rotation.Pass, rotation.Processed, rotation.Total, rotation.Resealed)
+	if rotation.Unreadable > 0 {
+		text += fmt.Sprintf("\n⚠️ %d stored values couldn't be opened in the last pass, key %s stays in use until they are fixed.",
+			rotation.Unreadable, rotation.FromKeyId)
+	}
+	if rotation.Status == RotationDone {
+		text = fmt.Sprintf("🔑 Key rotation %s → %s is done, %d resealed in total.\nKey %s is retired, set PEPPER_KEY_FILE to %s.",
+			rotation.FromKeyId, rotation.ToKeyId, rotation.Resealed, rotation.FromKeyId, rotation.ToKeyFile)
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendKeyRotationFailed(chatId int64, err error) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("❌ Key rotation failed: %s", err))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendNoKeyRotation(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 There was no key rotation yet. Use /rotate <key file> to start one.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendGeneratedPassword(chatId int64, password string, options generator.Options) {
+	msg := tgbotapi.NewMessage(chatId, fmt.Sprintf("🎲 Generated password:\n<code>%s</code>", html.EscapeString(password)))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = generatorKeyboard(options)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendPasswordWarning(chatId int64, result strength.Result, breaches int) {
+	var text strings.Builder
+	if breaches > 0 {
+		fmt.Fprintf(&text, "🔴 This password was found in data breaches %d times, attackers try it first.", breaches)
+	}
+	if result.Score < strength.Acceptable {
+		if text.Len() > 0 {
+			text.WriteString("\n\n")
+		}
+
+		fmt.Fprintf(&text, "🟠 This password is weak, strength %d/4.", result.Score)
+		if result.Warning != "" {
+			fmt.Fprintf(&text, "\n%s", result.Warning)
+		}
+		for _, suggestion := range result.Suggestions {
+			fmt.Fprintf(&text, "\n• %s", suggestion)
+		}
+	}
+
+	msg := tgbotapi.NewMessage(chatId, text.String())
+	msg.ReplyMarkup = keyboardWeakPassword
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendOtpAdded(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "✅ Success. Your one-time code secret has been encrypted and added.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendInvalidOtpSecret(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ This is not an otpauth:// link or a base32 secret. Please try again.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendAlreadyHaveOtpName(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 You already have a one-time code with this name. Please enter another name.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendWrongRecoveryCode(chatId int64, attemptsLeft int) {
+	text := fmt.Sprintf("❌ Wrong or already used recovery code. Attempts left: %d.", attemptsLeft)
+	if attemptsLeft == 0 {
+		text = "❌ Wrong or already used recovery code. No attempts left, please start again with /recover."
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendNoRecoveryCodes(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 You don't have any unused recovery codes. If you remember your pin code, create new ones with /codes.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendVaultRecovered(chatId int64, codesLeft int) {
+	text := fmt.Sprintf("✅ Success. Your pin code has been changed. Recovery codes left: %d.", codesLeft)
+	if codesLeft == 0 {
+		text = "✅ Success. Your pin code has been changed. That was your last recovery code, create new ones with /codes."
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// SendShare sends one share as a text document. from is empty for the
+// vault owner, otherwise it names the owner for a trusted user. The error
+// is returned instead of panicking, a trusted user may never have started
+// the bot.
+func (s *messageService) SendShare(chatId int64, number int, shares *ShareSet, from string, share secret.Secret) (tgbotapi.Message, error) {
+	content := fmt.Sprintf("Password Guard recovery share %d of %d\nAny %d shares of this split set a new pin code with /recover_shares.\n\n%s\n", number, shares.Count, shares.Threshold, share.Bytes())
+
+	doc := tgbotapi.NewDocument(chatId, tgbotapi.FileBytes{Name: fmt.Sprintf("recovery-share-%s-%d.txt", shares.ID, number), Bytes: []byte(content)})
+	doc.Caption = fmt.Sprintf("🔑 Recovery share %d of %d.", number, shares.Count)
+	if from != "" {
+		doc.Caption = fmt.Sprintf("🔑 %s trusts you with a recovery share for their Password Guard vault. Keep this file safe and only give it back to them.", from)
+	}
+
+	return s.botApi.Send(doc)
+}
+
+// SendShareFailed tells the owner which share didn't arrive. Shares aren't
+// kept, only a new split brings it back.
+func (s *messageService) SendShareFailed(chatId int64, number int, shares *ShareSet) {
+	text := fmt.Sprintf("❌ Recovery share %d of %d could not be sent. Split access again with /shares to get a full set.", number, shares.Count)
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendSharesCreated(chatId int64, threshold, count int) {
+	text := fmt.Sprintf("✅ Success. Any %d of these %d shares set a new pin code with /recover_shares, shares of your previous split no longer work.\n🟠 NOTICE: The files will be deleted in 5 minutes. Save them and keep them in different places, never all together.", threshold, count)
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendSharesDelivered(chatId int64, delivered int, failed []int64) {
+	text := fmt.Sprintf("✅ Success. %d shares were sent to your trusted users, shares of your previous split no longer work.", delivered)
+	if len(failed) > 0 {
+		ids := make([]string, len(failed))
+		for i, id := range failed {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+
+		text += fmt.Sprintf("\n🟠 These users haven't started the bot, their shares are sent to you instead and will be deleted in 5 minutes: %s.", strings.Join(ids, ", "))
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendInvalidTrustees(chatId int64, count int) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("❌ Please enter exactly %d different numeric Telegram user ids.", count))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendNoShares(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 Your vault was never split into shares. If you remember your pin code, create them with /shares.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendInvalidShare(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ This is not a share of your current split, or you already sent it. Please send another one.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendWrongShares(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "❌ These shares don't open your vault. Please start again with /recover_shares.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendNoHistory(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "🟠 This data has no earlier versions.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendVersionRestored(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "✅ Success. The version has been restored.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendNothingFound(chatId int64, query string) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("🟠 Nothing matches %q. Try another search.", query))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendFavorite(chatId int64, favorite bool) {
+	text := "⭐ Added to favorites. Favorites come first when you pick data."
+	if !favorite {
+		text = "✅ Removed from favorites."
+	}
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// SendEntryDetails shows when entry was created, changed and used, with a
+// hint for access the user doesn't recognize.
+func (s *messageService) SendEntryDetails(chatId int64, entry *Entry) {
+	var text strings.Builder
+
+	fmt.Fprintf(&text, "ℹ️ %s\n", entry.Name)
+	if folder := folderText(entry.Folder, entry.Tags); folder != "" {
+		fmt.Fprintf(&text, "📁 %s\n", folder)
+	}
+
+	fmt.Fprintf(&text, "Created: %s\n", entry.CreatedAt.UTC().Format("2006-01-02 15:04 UTC"))
+	fmt.Fprintf(&text, "Updated: %s\n", entry.UpdatedAt.UTC().Format("2006-01-02 15:04 UTC"))
+
+	if entry.AccessedAt == nil {
+		text.WriteString("Last used: no reveals recorded yet\n")
+	} else {
+		fmt.Fprintf(&text, "Last used: %s (%s)\n", timeAgo(time.Since(*entry.AccessedAt)), entry.AccessedAt.UTC().Format("2006-01-02 15:04 UTC"))
+		fmt.Fprintf(&text, "Revealed: %s\n", plural(entry.AccessCount, "time"))
+	}
+
+	text.WriteString("\n🟠 If you don't remember revealing it then, change your pin code with /pin.")
+
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text.String())); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendSettingsSaved(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "✅ Success. Your settings have been saved.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendAttachmentSaved(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "✅ Success. The file is encrypted and attached, your message with it has been deleted.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) SendAttachmentTooLarge(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("❌ This file is too large. Files up to %d MB can be attached, please send a smaller one.", maxAttachmentSize>>20))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// SendAttachment sends content as a document with a notice that it will be
+// deleted after lifetime, the caller deletes it. Reading content can fail,
+// so the error is returned rather than logged.
+func (s *messageService) SendAttachment(chatId int64, name string, content io.Reader, lifetime time.Duration) (tgbotapi.Message, error) {
+	doc := tgbotapi.NewDocument(chatId, tgbotapi.FileReader{Name: name, Reader: content})
+	doc.Caption = fmt.Sprintf("🟠 NOTICE: This file will be deleted in %d seconds. Save it if you need it.", int(lifetime.Seconds()))
+
+	return s.botApi.Send(doc)
+}
+
+// DownloadFile returns the content of a file sent to the bot. Errors don't
+// carry the download URL, it contains the bot token.
+func (s *messageService) DownloadFile(fileId string) ([]byte, error) {
+	body, err := s.OpenFile(fileId, maxDownloadSize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// OpenFile works like DownloadFile for files too large to keep in memory,
+// the caller reads and closes the content. Reading fails with
+// ErrFileTooLarge past limit bytes, whatever size Telegram reported.
+func (s *messageService) OpenFile(fileId string, limit int64) (io.ReadCloser, error) {
+	url, err := s.botApi.GetFileDirectURL(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Get(url)
+	if err != nil {
+		return nil, errors.New("failed to download file")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+
+	return &limitedBody{ReadCloser: resp.Body, left: limit}, nil
+}
+
+// limitedBody reads one byte past the limit to tell a file of exactly the
+// limit from a larger one. Once past it, every read fails.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, ErrFileTooLarge
+	}
+
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n + int(b.left), ErrFileTooLarge
+	}
+
+	return n, err
+}
+
+func generatorKeyboard(options generator.Options) tgbotapi.InlineKeyboardMarkup {
+	toggle := func(enabled bool, label, data string) tgbotapi.InlineKeyboardButton {
+		if enabled {
+			return tgbotapi.NewInlineKeyboardButtonData("✅ "+label, data)
+		}
+		return tgbotapi.NewInlineKeyboardButtonData("⬜ "+label, data)
+	}
+
+	size := fmt.Sprintf("Length: %d", options.Length)
+	mode := "📖 Passphrase"
+	if options.Passphrase {
+		size = fmt.Sprintf("Words: %d", options.Words)
+		mode = "🔤 Password"
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➖", "gen-shorter"),
+			tgbotapi.NewInlineKeyboardButtonData(size, "gen-new"),
+			tgbotapi.NewInlineKeyboardButtonData("➕", "gen-longer"),
+		),
+	}
+
+	if !options.Passphrase {
+		rows = append(rows,
+			tgbotapi.NewInlineKeyboardRow(
+				toggle(options.Lower, "a-z", "gen-lower"),
+				toggle(options.Upper, "A-Z", "gen-upper"),
+				toggle(options.Digits, "0-9", "gen-digits"),
+				toggle(options.Symbols, "!@#", "gen-symbols"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				toggle(options.ExcludeAmbiguous, "No look-alikes (l, 1, O, 0)", "gen-ambiguous"),
+			),
+		)
+	}
+
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(mode, "gen-mode"),
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Regenerate", "gen-new"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💾 Save as new entry", "gen-save"),
+		),
+	)
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
 func (s *messageService) AskPin(chatId int64, register bool) {
 	if register {
-		if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "2️⃣ Enter pin code. You can use one pin code for all data or one pin code for some data.\n🟠NOTICE: If you will lose your pin code we can not decrypt your data.")); err != nil {
+		if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "2️⃣ Create pin code. One pin code protects all your data, you can change it later with /pin.\n🟠NOTICE: If you will lose your pin code we can not decrypt your data, unless you have a recovery code.")); err != nil {
 			s.logger.Panic(err)
 		}
 	} else {
@@ -150,6 +723,24 @@ func (s *messageService) AskPin(chatId int64, register bool) {
 	}
 }
 
+func (s *messageService) AskCurrentPin(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "1️⃣ Enter current pin code.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskNewPin(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "2️⃣ Enter new pin code.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskConfirmPin(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "3️⃣ Enter new pin code again.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
 func (s *messageService) AskLogin(chatId int64) {
 	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "3️⃣ Enter login.")); err != nil {
 		s.logger.Panic(err)
@@ -162,12 +753,116 @@ func (s *messageService) AskPassword(chatId int64) {
 	}
 }
 
+func (s *messageService) AskURL(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "5️⃣ Enter the website address.")
+	msg.ReplyMarkup = keyboardSkip
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskNotes(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "6️⃣ Enter notes, like security questions or recovery hints.")
+	msg.ReplyMarkup = keyboardSkip
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskNoteContent(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "3️⃣ Enter the note. Line breaks and spacing are kept exactly, so it can hold recovery phrases, keys or configs.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// AskCustomField asks for the name of another custom field, listing the
+// fields entered so far.
+func (s *messageService) AskCustomField(chatId int64, fields []CustomField) {
+	msg := tgbotapi.NewMessage(chatId, "7️⃣ Add a custom field, like a security question, an account number or a PIN? Enter its name.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Done", "fields-done"),
+		),
+	)
+
+	if len(fields) > 0 {
+		names := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = field.Name
+			if field.Hidden {
+				names[i] += " (hidden)"
+			}
+		}
+
+		msg.Text += fmt.Sprintf("\nFields so far: %s.", strings.Join(names, ", "))
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Done", "fields-done"),
+				tgbotapi.NewInlineKeyboardButtonData("🗑 Remove all", "fields-clear"),
+			),
+		)
+	}
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskFieldValue(chatId int64, name string) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("7️⃣ Enter the value of %s.", name))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskFieldHidden(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "7️⃣ Should the value be hidden when the data is decrypted? A hidden value is only shown when you ask for it.")
+	msg.ReplyMarkup = keyboardFieldHidden
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// AskFolder offers to keep current, the folder and tags the entry already
+// has, or to remove them.
+func (s *messageService) AskFolder(chatId int64, current string) {
+	msg := tgbotapi.NewMessage(chatId, "8️⃣ Enter a folder and tags, like: work/mail #email #2fa")
+	msg.ReplyMarkup = keyboardSkip
+
+	if current != "" {
+		msg.Text += fmt.Sprintf("\nNow it is %s, skip to keep it.", current)
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Skip", "skip"),
+				tgbotapi.NewInlineKeyboardButtonData("No folder", "folder-none"),
+			),
+		)
+	}
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
 func (s *messageService) AskNewNameFromData(chatId int64) {
 	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "Please enter new name.")); err != nil {
 		s.logger.Panic(err)
 	}
 }
 
+func (s *messageService) AskWhichGroup(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ Pick a folder or a tag.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
 func (s *messageService) AskWhatDecrypt(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
 	msg := tgbotapi.NewMessage(chatId, "1️⃣ What do you want to decrypt?")
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
@@ -200,3 +895,210 @@ func (s *messageService) AskWhatDelete(chatId int64, data [][]tgbotapi.InlineKey
 		s.logger.Panic(err)
 	}
 }
+
+func (s *messageService) AskWhatOtp(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	text := "1️⃣ Which one-time code do you want?"
+	if data == nil {
+		text = "🟠 You don't have one-time code secrets yet."
+	}
+
+	rows := append(data, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("➕ Add secret", "otp-add"),
+	))
+
+	msg := tgbotapi.NewMessage(chatId, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		rows...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatHistory(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ Which data's history do you want to see?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatAttach(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ Which data do you want to attach a file to?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatInfo(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ Which data do you want to see the details of?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatFavorite(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ Which data do you want to add to favorites or remove from them?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+// AskEntryOrder offers the orders of the entry pickers, current is marked.
+func (s *messageService) AskEntryOrder(chatId int64, current string) {
+	option := func(order, label, data string) tgbotapi.InlineKeyboardButton {
+		if order == current {
+			return tgbotapi.NewInlineKeyboardButtonData("✅ "+label, data)
+		}
+
+		return tgbotapi.NewInlineKeyboardButtonData(label, data)
+	}
+
+	msg := tgbotapi.NewMessage(chatId, "⚙️ How should your data be sorted when you pick it? Favorites always come first.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(option(entryOrderName, "🔤 By name", "order-name")),
+		tgbotapi.NewInlineKeyboardRow(option(entryOrderRecent, "🕓 Recently used", "order-recent")),
+		tgbotapi.NewInlineKeyboardRow(option(entryOrderFrequent, "🔥 Most used", "order-frequent")),
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskAttachment(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("3️⃣ Send the file as a document, up to %d MB. It will be encrypted and your message deleted.", maxAttachmentSize>>20))); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatReveal(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "🔒 This data has hidden fields or attached files. Which one do you want to see? You will be asked for the pin code again.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhichVersion(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "2️⃣ Which version? The newest is on top.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskVersionAction(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "3️⃣ Do you want to see this version or restore it?")
+	msg.ReplyMarkup = keyboardVersionAction
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskFindQuery(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "1️⃣ What are you looking for? Enter a part of the name.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskWhatFound(chatId int64, data [][]tgbotapi.InlineKeyboardButton) {
+	msg := tgbotapi.NewMessage(chatId, "2️⃣ Best matches first. Pick one, or enter another search.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		data...,
+	)
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskEntryAction(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "3️⃣ What do you want to do with it?")
+	msg.ReplyMarkup = keyboardEntryAction
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskOtpName(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "1️⃣ Enter a name for the one-time code.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskOtpSecret(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "3️⃣ Enter the otpauth:// link or the base32 secret shown when you set up two-factor authentication.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskCreateRecoveryCodes(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "🔑 Create recovery codes? Each of them works once and lets you set a new pin code with /recover if you forget it.")
+	msg.ReplyMarkup = keyboardRecoveryCodes
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskRecoveryCode(chatId int64) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, "1️⃣ Enter one of your recovery codes.")); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskSharesSize(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "1️⃣ How many shares, and how many of them are needed to set a new pin code?")
+	msg.ReplyMarkup = keyboardSharesSize
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskSharesDelivery(chatId int64) {
+	msg := tgbotapi.NewMessage(chatId, "2️⃣ Where should the shares go?")
+	msg.ReplyMarkup = keyboardSharesDelivery
+
+	if _, err := s.botApi.Send(msg); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskTrustees(chatId int64, count int) {
+	text := fmt.Sprintf("3️⃣ Enter the Telegram user ids of %d trusted people, separated by spaces. Each of them gets one share, they have to start this bot first.", count)
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, text)); err != nil {
+		s.logger.Panic(err)
+	}
+}
+
+func (s *messageService) AskShare(chatId int64, needed int) {
+	if _, err := s.botApi.Send(tgbotapi.NewMessage(chatId, fmt.Sprintf("1️⃣ Send a share file or paste its text. Shares still needed: %d.", needed))); err != nil {
+		s.logger.Panic(err)
+	}
+}
@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimitedBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		limit   int64
+		buffer  int
+		wantErr error
+	}{
+		{"under the limit", "abc", 4, 2, nil},
+		{"exactly the limit", "abcd", 4, 3, nil},
+		{"past the limit", "abcdefghij", 4, 3, ErrFileTooLarge},
+		{"past the limit in one read", "abcdefghij", 4, 64, ErrFileTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := &limitedBody{ReadCloser: io.NopCloser(strings.NewReader(tc.content)), left: tc.limit}
+
+			var read []byte
+			var err error
+			buffer := make([]byte, tc.buffer)
+			for err == nil {
+				var n int
+				n, err = body.Read(buffer)
+				if n < 0 || n > len(buffer) {
+					t.Fatalf("Read() = %d, want 0 to %d", n, len(buffer))
+				}
+				read = append(read, buffer[:n]...)
+			}
+
+			if err == io.EOF {
+				err = nil
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tc.wantErr)
+			}
+			if int64(len(read)) > tc.limit {
+				t.Errorf("read %d bytes, want at most %d", len(read), tc.limit)
+			}
+			if tc.wantErr == nil && string(read) != tc.content {
+				t.Errorf("read %q, want %q", read, tc.content)
+			}
+
+			// Reads after the limit keep failing without reporting data.
+			if tc.wantErr != nil {
+				for i := 0; i < 3; i++ {
+					if n, err := body.Read(buffer); n != 0 || !errors.Is(err, ErrFileTooLarge) {
+						t.Errorf("Read() after the limit = %d, %v, want 0, %v", n, err, ErrFileTooLarge)
+					}
+				}
+			}
+		})
+	}
+}
@@ -3,22 +3,65 @@ package bot
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
+// ErrVaultChanged is returned by SwapVault when the vault was changed
+// since it was read.
+var ErrVaultChanged = errors.New("vault was changed concurrently")
+
 //go:generate mockgen -source=repository.go -destination=mocks/repository_mock.go
 type Repository interface {
 	GetUser(ctx context.Context, filter bson.M) (*User, error)
-	GetUserWithSliceAndDataSize(ctx context.Context, filter bson.M, page int) (*User, *int, error)
+	UpdateSettings(ctx context.Context, telegramId int64, settings *UserSettings) error
 	CreatUser(ctx context.Context, user *User) error
 	CreateUniqueIndexes(ctx context.Context) error
+	MigrateDataToEntries(ctx context.Context) (int64, error)
+	MigrateEntriesToCollection(ctx context.Context) (int64, error)
 	UpdateUser(ctx context.Context, user *User) error
+	SwapVault(ctx context.Context, user *User, previousWrappedKey string) error
 	DeleteData(ctx context.Context, filter bson.M) error
+
+	GetEntry(ctx context.Context, telegramId int64, id primitive.ObjectID) (*EntryRecord, error)
+	GetEntryByName(ctx context.Context, telegramId int64, name string) (*EntryRecord, error)
+	GetEntries(ctx context.Context, telegramId int64) ([]EntryRecord, error)
+	GetEntriesPage(ctx context.Context, telegramId int64, group *EntryGroup, order string, page int) ([]EntryRecord, int64, error)
+	GetOtpEntriesPage(ctx context.Context, telegramId int64, page int) ([]EntryRecord, int64, error)
+	GetEntryGroups(ctx context.Context, telegramId int64) ([]EntryGroup, error)
+	GetEntryNamesAfter(ctx context.Context, telegramId int64, after primitive.ObjectID, limit int64) ([]EntryRecord, error)
+	UpsertEntry(ctx context.Context, record *EntryRecord) error
+	UpdateEntry(ctx context.Context, record *EntryRecord) error
+	SwapEntryPayloads(ctx context.Context, record *EntryRecord, previousPayload string) (bool, error)
+	SetEntryFavorite(ctx context.Context, telegramId int64, id primitive.ObjectID, favorite bool) error
+	RecordEntryAccess(ctx context.Context, telegramId int64, id primitive.ObjectID, at time.Time) error
+	DeleteEntry(ctx context.Context, telegramId int64, id primitive.ObjectID) error
+
+	UploadAttachment(ctx context.Context, attachment *Attachment, src io.Reader) error
+	GetAttachment(ctx context.Context, telegramId int64, id primitive.ObjectID) (*Attachment, error)
+	GetAttachments(ctx context.Context, telegramId int64, entryId primitive.ObjectID) ([]Attachment, error)
+	OpenAttachment(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error)
+	SwapAttachmentName(ctx context.Context, attachment *Attachment, previousName string) (bool, error)
+	DeleteAttachments(ctx context.Context, telegramId int64, entryId primitive.ObjectID) error
+
+	GetUserIdsAfter(ctx context.Context, after primitive.ObjectID, limit int64) ([]primitive.ObjectID, error)
+	CountUsers(ctx context.Context) (int64, error)
+	ModifyUser(ctx context.Context, id primitive.ObjectID, modify func(user *User) (bool, error)) (bool, error)
+	CountSealedWith(ctx context.Context, prefix string) (int64, error)
+
+	GetLastKeyRotation(ctx context.Context) (*KeyRotation, error)
+	CreateKeyRotation(ctx context.Context, rotation *KeyRotation) error
+	UpdateKeyRotation(ctx context.Context, rotation *KeyRotation) error
 }
 
 type repository struct {
@@ -57,50 +100,16 @@ func (r *repository) GetUser(ctx context.Context, filter bson.M) (*User, error)
 	return &user, nil
 }
 
-func (r *repository) GetUserWithSliceAndDataSize(ctx context.Context, filter bson.M, page int) (*User, *int, error) {
-	var dbUser struct {
-		ID         primitive.ObjectID  `bson:"_id"`
-		TelegramId int64               `bson:"telegram_id"`
-		Data       []map[string]string `bson:"data"`
-		DataSize   int                 `bson:"data_size"`
-	}
-
-	limit := 9
-	offset := (page - 1) * limit
-
-	projection := bson.M{
-		"data": bson.M{
-			"$slice": bson.A{bson.D{{Key: "$objectToArray", Value: "$data"}}, offset, limit},
-		},
-		"data_size": bson.M{
-			"$size": bson.A{bson.D{{Key: "$objectToArray", Value: "$data"}}},
-		},
-	}
-
-	options := options.FindOne().SetProjection(projection)
-
-	if err := r.db.Database(r.dbName).Collection("data").FindOne(ctx, filter, options).Decode(&dbUser); err != nil {
-		if err == mongo.ErrNoDocuments {
-			r.logger.Errorf("failed to find user by name: %s", err)
-			return nil, nil, err
-		}
-
-		r.logger.Errorf("failed to find user due to internal error: s", err)
-		return nil, nil, err
-	}
-
-	var user User
-	user.ID = dbUser.ID
-	user.TelegramId = dbUser.TelegramId
-
-	data := make(map[string]string)
-	for _, item := range dbUser.Data {
-		data[item["k"]] = item["v"]
+// UpdateSettings replaces the settings of the user.
+func (r *repository) UpdateSettings(ctx context.Context, telegramId int64, settings *UserSettings) error {
+	_, err := r.db.Database(r.dbName).Collection("data").UpdateOne(ctx, bson.M{"telegram_id": telegramId},
+		bson.M{"$set": bson.M{"settings": settings}})
+	if err != nil {
+		r.logger.Errorf("failed to update settings %s", err)
+		return err
 	}
 
-	user.Data = &data
-
-	return &user, &dbUser.DataSize, nil
+	return nil
 }
 
 func (r *repository) CreatUser(ctx context.Context, user *User) error {
@@ -129,6 +138,172 @@ func (r *repository) CreateUniqueIndexes(ctx context.Context) error {
 		return err
 	}
 
+	entryMod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "telegram_id", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	_, err = r.db.Database(r.dbName).Collection("entries").Indexes().CreateOne(ctx, entryMod)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MigrateDataToEntries moves the entries of the old "data" map, name to
+// encrypted "login:password", into the entries array. The payloads can
+// only be rewritten with the user's pin, so they are marked as legacy and
+// converted on their next decryption. When the entries were created is not
+// known, they get the time of the migration.
+func (r *repository) MigrateDataToEntries(ctx context.Context) (int64, error) {
+	migrated := bson.D{
+		{Key: "name", Value: "$$item.k"},
+		{Key: "payload", Value: "$$item.v"},
+		{Key: "format", Value: entryFormatLegacy},
+		{Key: "created_at", Value: "$$NOW"},
+		{Key: "updated_at", Value: "$$NOW"},
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"entries": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$entries", bson.A{}}},
+				bson.M{"$map": bson.M{
+					"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$data", bson.M{}}}},
+					"as":    "item",
+					"in":    migrated,
+				}},
+			}},
+		}}},
+		{{Key: "$unset", Value: "data"}},
+	}
+
+	result, err := r.db.Database(r.dbName).Collection("data").UpdateMany(ctx, bson.M{"data": bson.M{"$exists": true}}, pipeline)
+	if err != nil {
+		r.logger.Errorf("failed to migrate data to entries: %s", err)
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// MigrateEntriesToCollection moves the entries array and the otp map of
+// every user document into the entries collection. A user whose move was
+// interrupted is moved again, the entries that were already inserted are
+// skipped.
+func (r *repository) MigrateEntriesToCollection(ctx context.Context) (int64, error) {
+	users := r.db.Database(r.dbName).Collection("data")
+	entries := r.db.Database(r.dbName).Collection("entries")
+
+	filter := bson.M{"$or": bson.A{bson.M{"entries": bson.M{"$exists": true}}, bson.M{"otp": bson.M{"$exists": true}}}}
+
+	cursor, err := users.Find(ctx, filter, options.Find().SetProjection(bson.M{"telegram_id": 1, "entries": 1, "otp": 1}))
+	if err != nil {
+		r.logger.Errorf("failed to find users to migrate entries: %s", err)
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var migrated int64
+	for cursor.Next(ctx) {
+		var user struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			TelegramId int64              `bson:"telegram_id"`
+			Entries    []EntryRecord      `bson:"entries"`
+			Otp        map[string]string  `bson:"otp"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			r.logger.Errorf("failed to decode user to migrate entries: %s", err)
+			return migrated, err
+		}
+
+		if len(user.Entries) > 0 {
+			documents := make([]interface{}, 0, len(user.Entries))
+			for _, entry := range user.Entries {
+				entry.ID = primitive.NewObjectID()
+				entry.TelegramId = user.TelegramId
+				documents = append(documents, entry)
+			}
+
+			_, err := entries.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				r.logger.Errorf("failed to insert migrated entries: %s", err)
+				return migrated, err
+			}
+		}
+
+		if err := r.migrateOtp(ctx, user.TelegramId, user.Otp); err != nil {
+			return migrated, err
+		}
+
+		if _, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"entries": "", "otp": ""}}); err != nil {
+			r.logger.Errorf("failed to remove migrated entries: %s", err)
+			return migrated, err
+		}
+
+		migrated++
+	}
+
+	if err := cursor.Err(); err != nil {
+		r.logger.Errorf("failed to iterate users to migrate entries: %s", err)
+		return migrated, err
+	}
+
+	return migrated, nil
+}
+
+// migrateOtp inserts the secrets of an otp map, name to sealed and
+// encrypted secret, as one-time code entries. Entries share their names, a
+// secret named like another entry gets a suffix. A secret already moved
+// by an interrupted run is skipped.
+func (r *repository) migrateOtp(ctx context.Context, telegramId int64, otp map[string]string) error {
+	names := make([]string, 0, len(otp))
+	for name := range otp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		now := time.Now()
+		record := EntryRecord{
+			TelegramId: telegramId,
+			Name:       name,
+			Type:       entryTypeOtp,
+			Payload:    otp[name],
+			Format:     entryFormatSecret,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+
+		for i := 1; ; i++ {
+			existing, err := r.GetEntryByName(ctx, telegramId, record.Name)
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if existing.Type == entryTypeOtp && existing.Payload == record.Payload {
+				record.Name = ""
+				break
+			}
+
+			record.Name = fmt.Sprintf("%s (otp %d)", name, i)
+		}
+
+		if record.Name == "" {
+			continue
+		}
+
+		record.ID = primitive.NewObjectID()
+		if _, err := r.db.Database(r.dbName).Collection("entries").InsertOne(ctx, record); err != nil {
+			r.logger.Errorf("failed to insert migrated otp secret: %s", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -144,6 +319,30 @@ func (r *repository) UpdateUser(ctx context.Context, user *User) error {
 	return nil
 }
 
+// SwapVault stores the vault of user, but only if
+// the stored vault is still wrapped as previousWrappedKey. An empty
+// previousWrappedKey means the user must not have a vault yet.
+func (r *repository) SwapVault(ctx context.Context, user *User, previousWrappedKey string) error {
+	filter := bson.M{"telegram_id": user.TelegramId, "vault.wrapped_key": previousWrappedKey}
+	if previousWrappedKey == "" {
+		filter = bson.M{"telegram_id": user.TelegramId, "vault": bson.M{"$exists": false}}
+	}
+
+	result, err := r.db.Database(r.dbName).Collection("data").UpdateOne(ctx, filter,
+		bson.D{primitive.E{Key: "$set", Value: bson.M{"vault": user.Vault}}})
+	if err != nil {
+		r.logger.Errorf("failed to swap user vault %s", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		r.logger.Errorf("failed to swap user vault: %s", ErrVaultChanged)
+		return ErrVaultChanged
+	}
+
+	return nil
+}
+
 func (r *repository) DeleteData(ctx context.Context, filter bson.M) error {
 	_, err := r.db.Database(r.dbName).Collection("data").DeleteOne(ctx, filter)
 	if err != nil {
@@ -153,3 +352,631 @@ func (r *repository) DeleteData(ctx context.Context, filter bson.M) error {
 
 	return nil
 }
+
+func (r *repository) GetEntry(ctx context.Context, telegramId int64, id primitive.ObjectID) (*EntryRecord, error) {
+	return r.findEntry(ctx, bson.M{"_id": id, "telegram_id": telegramId})
+}
+
+func (r *repository) GetEntryByName(ctx context.Context, telegramId int64, name string) (*EntryRecord, error) {
+	return r.findEntry(ctx, bson.M{"telegram_id": telegramId, "name": name})
+}
+
+func (r *repository) findEntry(ctx context.Context, filter bson.M) (*EntryRecord, error) {
+	var record EntryRecord
+
+	if err := r.db.Database(r.dbName).Collection("entries").FindOne(ctx, filter).Decode(&record); err != nil {
+		if err != mongo.ErrNoDocuments {
+			r.logger.Errorf("failed to find entry: %s", err)
+		}
+
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (r *repository) GetEntries(ctx context.Context, telegramId int64) ([]EntryRecord, error) {
+	cursor, err := r.db.Database(r.dbName).Collection("entries").Find(ctx, bson.M{"telegram_id": telegramId})
+	if err != nil {
+		r.logger.Errorf("failed to find entries: %s", err)
+		return nil, err
+	}
+
+	var records []EntryRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		r.logger.Errorf("failed to decode entries: %s", err)
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// GetEntriesPage returns the ids, names, types and favorite flags of one page
+// of entries in group, or of all entries if group is nil, in order, together
+// with their number.
+func (r *repository) GetEntriesPage(ctx context.Context, telegramId int64, group *EntryGroup, order string, page int) ([]EntryRecord, int64, error) {
+	return r.findEntriesPage(ctx, entryGroupFilter(telegramId, group), entrySort(order), page)
+}
+
+// GetOtpEntriesPage returns one page of the user's one-time code secrets like
+// GetEntriesPage, sorted by name.
+func (r *repository) GetOtpEntriesPage(ctx context.Context, telegramId int64, page int) ([]EntryRecord, int64, error) {
+	filter := bson.M{"telegram_id": telegramId, "type": entryTypeOtp}
+
+	return r.findEntriesPage(ctx, filter, bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}, page)
+}
+
+func (r *repository) findEntriesPage(ctx context.Context, filter bson.M, sort bson.D, page int) ([]EntryRecord, int64, error) {
+	limit := int64(9)
+	offset := int64(page-1) * limit
+
+	collection := r.db.Database(r.dbName).Collection("entries")
+
+	options := options.Find().
+		SetProjection(bson.M{"name": 1, "type": 1, "favorite": 1}).
+		SetSort(sort).
+		SetSkip(offset).
+		SetLimit(limit)
+
+	cursor, err := collection.Find(ctx, filter, options)
+	if err != nil {
+		r.logger.Errorf("failed to find entries page: %s", err)
+		return nil, 0, err
+	}
+
+	var records []EntryRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		r.logger.Errorf("failed to decode entries page: %s", err)
+		return nil, 0, err
+	}
+
+	size, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		r.logger.Errorf("failed to count entries: %s", err)
+		return nil, 0, err
+	}
+
+	return records, size, nil
+}
+
+// GetEntryGroups returns the folders and then the tags of the user's
+// entries, sorted, with the group of entries without a folder last and the
+// favorites first. It returns nil if no entry has a folder or a tag.
+func (r *repository) GetEntryGroups(ctx context.Context, telegramId int64) ([]EntryGroup, error) {
+	collection := r.db.Database(r.dbName).Collection("entries")
+
+	folders, err := collection.Distinct(ctx, "folder", bson.M{"telegram_id": telegramId, "folder": bson.M{"$nin": bson.A{nil, ""}}})
+	if err != nil {
+		r.logger.Errorf("failed to find entry folders: %s", err)
+		return nil, err
+	}
+
+	tags, err := collection.Distinct(ctx, "tags", bson.M{"telegram_id": telegramId})
+	if err != nil {
+		r.logger.Errorf("failed to find entry tags: %s", err)
+		return nil, err
+	}
+
+	if len(folders) == 0 && len(tags) == 0 {
+		return nil, nil
+	}
+
+	favorites, err := collection.CountDocuments(ctx, entryGroupFilter(telegramId, &EntryGroup{Favorites: true}))
+	if err != nil {
+		r.logger.Errorf("failed to count entries: %s", err)
+		return nil, err
+	}
+
+	var groups []EntryGroup
+	if favorites > 0 {
+		groups = append(groups, EntryGroup{Favorites: true})
+	}
+	for _, folder := range sortedStrings(folders) {
+		groups = append(groups, EntryGroup{Folder: folder})
+	}
+	for _, tag := range sortedStrings(tags) {
+		groups = append(groups, EntryGroup{Tag: tag})
+	}
+
+	unfiled, err := collection.CountDocuments(ctx, entryGroupFilter(telegramId, &EntryGroup{}))
+	if err != nil {
+		r.logger.Errorf("failed to count entries: %s", err)
+		return nil, err
+	}
+
+	if unfiled > 0 {
+		groups = append(groups, EntryGroup{})
+	}
+
+	return groups, nil
+}
+
+// GetEntryNamesAfter returns the ids, names, types and favorite flags of up to
+// limit entries of the user with an id after after, to walk all of them in
+// batches. One-time code secrets are left out like in the pickers.
+func (r *repository) GetEntryNamesAfter(ctx context.Context, telegramId int64, after primitive.ObjectID, limit int64) ([]EntryRecord, error) {
+	options := options.Find().
+		SetProjection(bson.M{"name": 1, "type": 1, "favorite": 1}).
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(limit)
+
+	cursor, err := r.db.Database(r.dbName).Collection("entries").Find(ctx, bson.M{"telegram_id": telegramId, "type": bson.M{"$ne": entryTypeOtp}, "_id": bson.M{"$gt": after}}, options)
+	if err != nil {
+		r.logger.Errorf("failed to find entry names: %s", err)
+		return nil, err
+	}
+
+	var records []EntryRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		r.logger.Errorf("failed to decode entry names: %s", err)
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// entryGroupFilter matches the entries of group. One-time code secrets are
+// only listed by /otp, never in the entry pickers.
+func entryGroupFilter(telegramId int64, group *EntryGroup) bson.M {
+	filter := bson.M{"telegram_id": telegramId, "type": bson.M{"$ne": entryTypeOtp}}
+
+	switch {
+	case group == nil:
+	case group.Favorites:
+		filter["favorite"] = true
+	case group.Tag != "":
+		filter["tags"] = group.Tag
+	case group.Folder != "":
+		filter["folder"] = group.Folder
+	default:
+		// Also matches entries from before folders, without the field.
+		filter["folder"] = bson.M{"$in": bson.A{nil, ""}}
+	}
+
+	return filter
+}
+
+// entrySort sorts entries by order with the favorites first. The name and
+// then the id break ties, so pages never overlap or skip an entry.
+func entrySort(order string) bson.D {
+	keys := bson.D{{Key: "favorite", Value: -1}}
+
+	switch order {
+	case entryOrderRecent:
+		keys = append(keys, bson.E{Key: "accessed_at", Value: -1})
+	case entryOrderFrequent:
+		keys = append(keys, bson.E{Key: "access_count", Value: -1})
+	}
+
+	return append(keys, bson.E{Key: "name", Value: 1}, bson.E{Key: "_id", Value: 1})
+}
+
+func sortedStrings(values []interface{}) []string {
+	sorted := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// UpsertEntry stores record under its name, replacing the payload of an
+// entry with the same name but keeping its id and creation time.
+func (r *repository) UpsertEntry(ctx context.Context, record *EntryRecord) error {
+	update := bson.M{
+		"$set": bson.M{
+			"type":       record.Type,
+			"folder":     record.Folder,
+			"tags":       record.Tags,
+			"payload":    record.Payload,
+			"format":     record.Format,
+			"updated_at": record.UpdatedAt,
+		},
+		"$setOnInsert": bson.M{
+			"_id":        record.ID,
+			"created_at": record.CreatedAt,
+		},
+	}
+
+	_, err := r.db.Database(r.dbName).Collection("entries").UpdateOne(ctx, bson.M{"telegram_id": record.TelegramId, "name": record.Name}, update,
+		options.Update().SetUpsert(true))
+	if err != nil {
+		r.logger.Errorf("failed to upsert entry %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) UpdateEntry(ctx context.Context, record *EntryRecord) error {
+	update := bson.M{
+		"$set": bson.M{
+			"name":       record.Name,
+			"type":       record.Type,
+			"folder":     record.Folder,
+			"tags":       record.Tags,
+			"payload":    record.Payload,
+			"format":     record.Format,
+			"history":    record.History,
+			"updated_at": record.UpdatedAt,
+		},
+	}
+
+	result, err := r.db.Database(r.dbName).Collection("entries").UpdateOne(ctx, bson.M{"_id": record.ID, "telegram_id": record.TelegramId}, update)
+	if err != nil {
+		r.logger.Errorf("failed to update entry %s", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// SwapEntryPayloads replaces the payload and the history of the entry only
+// if the payload is still previousPayload, it reports whether it did. The
+// history only changes together with the payload.
+func (r *repository) SwapEntryPayloads(ctx context.Context, record *EntryRecord, previousPayload string) (bool, error) {
+	result, err := r.db.Database(r.dbName).Collection("entries").UpdateOne(ctx, bson.M{"_id": record.ID, "payload": previousPayload},
+		bson.M{"$set": bson.M{"payload": record.Payload, "history": record.History}})
+	if err != nil {
+		r.logger.Errorf("failed to swap entry payload %s", err)
+		return false, err
+	}
+
+	return result.MatchedCount == 1, nil
+}
+
+func (r *repository) SetEntryFavorite(ctx context.Context, telegramId int64, id primitive.ObjectID, favorite bool) error {
+	result, err := r.db.Database(r.dbName).Collection("entries").UpdateOne(ctx, bson.M{"_id": id, "telegram_id": telegramId},
+		bson.M{"$set": bson.M{"favorite": favorite}})
+	if err != nil {
+		r.logger.Errorf("failed to update favorite %s", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// RecordEntryAccess notes that the entry was decrypted at at.
+func (r *repository) RecordEntryAccess(ctx context.Context, telegramId int64, id primitive.ObjectID, at time.Time) error {
+	_, err := r.db.Database(r.dbName).Collection("entries").UpdateOne(ctx, bson.M{"_id": id, "telegram_id": telegramId},
+		bson.M{"$set": bson.M{"accessed_at": at}, "$inc": bson.M{"access_count": 1}})
+	if err != nil {
+		r.logger.Errorf("failed to record entry access %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) DeleteEntry(ctx context.Context, telegramId int64, id primitive.ObjectID) error {
+	_, err := r.db.Database(r.dbName).Collection("entries").DeleteOne(ctx, bson.M{"_id": id, "telegram_id": telegramId})
+	if err != nil {
+		r.logger.Errorf("failed to delete entry %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// UploadAttachment stores src in the attachments bucket under the id of
+// attachment, with the rest of attachment as metadata. A failed upload
+// leaves nothing behind.
+func (r *repository) UploadAttachment(ctx context.Context, attachment *Attachment, src io.Reader) error {
+	bucket, err := r.attachments()
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := bucket.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	// The file name is in the encrypted metadata, GridFS only gets the id.
+	err = bucket.UploadFromStreamWithID(attachment.ID, attachment.ID.Hex(), src, options.GridFSUpload().SetMetadata(attachment))
+	if err != nil {
+		r.logger.Errorf("failed to upload attachment: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) GetAttachment(ctx context.Context, telegramId int64, id primitive.ObjectID) (*Attachment, error) {
+	attachments, err := r.findAttachments(ctx, bson.M{"_id": id, "metadata.telegram_id": telegramId})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attachments) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return &attachments[0], nil
+}
+
+// GetAttachments returns the attachments of the entry, oldest first, or
+// of all entries of the user if entryId is zero.
+func (r *repository) GetAttachments(ctx context.Context, telegramId int64, entryId primitive.ObjectID) ([]Attachment, error) {
+	filter := bson.M{"metadata.telegram_id": telegramId}
+	if !entryId.IsZero() {
+		filter["metadata.entry_id"] = entryId
+	}
+
+	return r.findAttachments(ctx, filter)
+}
+
+func (r *repository) findAttachments(ctx context.Context, filter bson.M) ([]Attachment, error) {
+	bucket, err := r.attachments()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := bucket.FindContext(ctx, filter, options.GridFSFind().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		r.logger.Errorf("failed to find attachments: %s", err)
+		return nil, err
+	}
+
+	var files []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Metadata Attachment         `bson:"metadata"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		r.logger.Errorf("failed to decode attachments: %s", err)
+		return nil, err
+	}
+
+	attachments := make([]Attachment, len(files))
+	for i, file := range files {
+		attachments[i] = file.Metadata
+		attachments[i].ID = file.ID
+	}
+
+	return attachments, nil
+}
+
+// OpenAttachment returns the stored content of the attachment, the caller
+// closes it. Check the owner with GetAttachment first.
+func (r *repository) OpenAttachment(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	bucket, err := r.attachments()
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := bucket.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		r.logger.Errorf("failed to open attachment: %s", err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// SwapAttachmentName replaces the encrypted name of the attachment only if
+// it is still previousName, it reports whether it did.
+func (r *repository) SwapAttachmentName(ctx context.Context, attachment *Attachment, previousName string) (bool, error) {
+	result, err := r.db.Database(r.dbName).Collection(attachmentBucket+".files").UpdateOne(ctx,
+		bson.M{"_id": attachment.ID, "metadata.name": previousName},
+		bson.M{"$set": bson.M{"metadata.name": attachment.Name}})
+	if err != nil {
+		r.logger.Errorf("failed to swap attachment name %s", err)
+		return false, err
+	}
+
+	return result.MatchedCount == 1, nil
+}
+
+func (r *repository) DeleteAttachments(ctx context.Context, telegramId int64, entryId primitive.ObjectID) error {
+	attachments, err := r.GetAttachments(ctx, telegramId, entryId)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := r.attachments()
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if err := bucket.DeleteContext(ctx, attachment.ID); err != nil && err != gridfs.ErrFileNotFound {
+			r.logger.Errorf("failed to delete attachment %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *repository) attachments() (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(r.db.Database(r.dbName), options.GridFSBucket().SetName(attachmentBucket))
+	if err != nil {
+		r.logger.Errorf("failed to open attachment bucket: %s", err)
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+func (r *repository) GetUserIdsAfter(ctx context.Context, after primitive.ObjectID, limit int64) ([]primitive.ObjectID, error) {
+	options := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(limit)
+
+	cursor, err := r.db.Database(r.dbName).Collection("data").Find(ctx, bson.M{"_id": bson.M{"$gt": after}}, options)
+	if err != nil {
+		r.logger.Errorf("failed to find user ids: %s", err)
+		return nil, err
+	}
+
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		r.logger.Errorf("failed to decode user ids: %s", err)
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	return ids, nil
+}
+
+func (r *repository) CountUsers(ctx context.Context) (int64, error) {
+	count, err := r.db.Database(r.dbName).Collection("data").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		r.logger.Errorf("failed to count users: %s", err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ModifyUser reads the user, lets modify change its vault, and
+// writes them back only if nobody changed them since the read, retrying
+// otherwise. It reports whether anything was written.
+func (r *repository) ModifyUser(ctx context.Context, id primitive.ObjectID, modify func(user *User) (bool, error)) (bool, error) {
+	const maxRetries = 5
+
+	collection := r.db.Database(r.dbName).Collection("data")
+
+	for i := 0; i < maxRetries; i++ {
+		raw, err := collection.FindOne(ctx, bson.M{"_id": id}).Raw()
+		if err != nil {
+			r.logger.Errorf("failed to find user for modify: %s", err)
+			return false, err
+		}
+
+		var user User
+		if err := bson.Unmarshal(raw, &user); err != nil {
+			r.logger.Errorf("failed to decode user for modify: %s", err)
+			return false, err
+		}
+
+		changed, err := modify(&user)
+		if err != nil || !changed {
+			return false, err
+		}
+
+		// Comparing the raw values keeps the field order, so the filter
+		// only matches the exact document we read.
+		filter := bson.M{"_id": id}
+		if value, err := raw.LookupErr("vault"); err == nil {
+			filter["vault"] = value
+		} else {
+			filter["vault"] = bson.M{"$exists": false}
+		}
+
+		if user.Vault == nil {
+			return false, nil
+		}
+
+		result, err := collection.UpdateOne(ctx, filter, bson.D{primitive.E{Key: "$set", Value: bson.M{"vault": user.Vault}}})
+		if err != nil {
+			r.logger.Errorf("failed to modify user %s", err)
+			return false, err
+		}
+
+		if result.MatchedCount == 1 {
+			return true, nil
+		}
+	}
+
+	r.logger.Errorf("failed to modify user %s: too many concurrent changes", id.Hex())
+	return false, errors.New("user is changed too often")
+}
+
+// CountSealedWith counts the users, entries and attachments that still hold
+// a value starting with prefix: a wrapped vault or recovery key, an entry
+// payload or version, or an attachment name.
+func (r *repository) CountSealedWith(ctx context.Context, prefix string) (int64, error) {
+	sealed := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}
+	db := r.db.Database(r.dbName)
+
+	filters := []struct {
+		collection string
+		filter     bson.M
+	}{
+		{"data", bson.M{"$or": bson.A{
+			bson.M{"vault.wrapped_key": sealed},
+			bson.M{"vault.recovery_keys": sealed},
+			bson.M{"vault.shares.wrapped_key": sealed},
+		}}},
+		{"entries", bson.M{"$or": bson.A{
+			bson.M{"payload": sealed},
+			bson.M{"history.payload": sealed},
+		}}},
+		{attachmentBucket + ".files", bson.M{"metadata.name": sealed}},
+	}
+
+	total := int64(0)
+	for _, f := range filters {
+		count, err := db.Collection(f.collection).CountDocuments(ctx, f.filter)
+		if err != nil {
+			r.logger.Errorf("failed to count sealed values in %s: %s", f.collection, err)
+			return 0, err
+		}
+
+		total += count
+	}
+
+	return total, nil
+}
+
+func (r *repository) GetLastKeyRotation(ctx context.Context) (*KeyRotation, error) {
+	var rotation KeyRotation
+
+	options := options.FindOne().SetSort(bson.M{"started_at": -1})
+	if err := r.db.Database(r.dbName).Collection("key_rotations").FindOne(ctx, bson.M{}, options).Decode(&rotation); err != nil {
+		if err != mongo.ErrNoDocuments {
+			r.logger.Errorf("failed to find key rotation: %s", err)
+		}
+
+		return nil, err
+	}
+
+	return &rotation, nil
+}
+
+func (r *repository) CreateKeyRotation(ctx context.Context, rotation *KeyRotation) error {
+	_, err := r.db.Database(r.dbName).Collection("key_rotations").InsertOne(ctx, rotation)
+	if err != nil {
+		r.logger.Errorf("failed to insert key rotation: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) UpdateKeyRotation(ctx context.Context, rotation *KeyRotation) error {
+	_, err := r.db.Database(r.dbName).Collection("key_rotations").UpdateOne(ctx, bson.M{"_id": rotation.ID},
+		bson.D{primitive.E{Key: "$set", Value: rotation}})
+	if err != nil {
+		r.logger.Errorf("failed to update key rotation %s", err)
+		return err
+	}
+
+	return nil
+}
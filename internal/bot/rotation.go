@@ -0,0 +1,495 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"password-guard-bot/pkg/crypto"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	rotationBatchSize  = 100
+	rotationRetryDelay = 30 * time.Second
+	rotationMaxRetries = 10
+)
+
+// ErrRotationRunning is returned by Start while another rotation is in
+// progress.
+var ErrRotationRunning = errors.New("key rotation is already running")
+
+// ErrRotationUnfinished is returned by Start while the last rotation has
+// stopped before it retired its old key. Its data may still be sealed with
+// that key, it has to finish first.
+var ErrRotationUnfinished = errors.New("the last key rotation hasn't finished, restart the bot to continue it")
+
+// errUnreadableValue marks stored data that can't be opened with any loaded
+// key, retrying won't help with it.
+var errUnreadableValue = errors.New("stored value can't be opened")
+
+// RotationService moves stored data to a new pepper key in the background.
+// New data is sealed with the new key as soon as the rotation starts, the
+// old key is retired once no user references it anymore.
+type RotationService interface {
+	Start(keyFile string) (*KeyRotation, error)
+	Resume() error
+	Status() (*KeyRotation, error)
+}
+
+type rotationService struct {
+	pepperSvc      crypto.PepperService
+	repository     Repository
+	logger         *zap.SugaredLogger
+	mu             sync.Mutex
+	running        bool
+	currentKeyFile string
+}
+
+func NewRotationService(pepperSvc crypto.PepperService, repository Repository, pepperKeyFile string, logger *zap.SugaredLogger) (RotationService, error) {
+	if pepperSvc == nil {
+		return nil, errors.New("invalid pepper service")
+	}
+	if repository == nil {
+		return nil, errors.New("invalid repository")
+	}
+	if pepperKeyFile == "" {
+		return nil, errors.New("invalid pepper key file")
+	}
+	if logger == nil {
+		return nil, errors.New("invalid logger")
+	}
+
+	return &rotationService{pepperSvc: pepperSvc, repository: repository, currentKeyFile: pepperKeyFile, logger: logger}, nil
+}
+
+func (s *rotationService) Start(keyFile string) (*KeyRotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return nil, ErrRotationRunning
+	}
+
+	last, err := s.repository.GetLastKeyRotation(context.Background())
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err == nil && last.Status != RotationDone {
+		return nil, ErrRotationUnfinished
+	}
+
+	key, err := crypto.LoadPepperKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	currentKeyId := s.pepperSvc.CurrentKeyId()
+	if key.Id == currentKeyId {
+		return nil, fmt.Errorf("pepper key %s is already in use", key.Id)
+	}
+
+	rotation, err := NewKeyRotation(currentKeyId, s.currentKeyFile, key.Id, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation.Total, err = s.repository.CountUsers(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repository.CreateKeyRotation(context.Background(), rotation); err != nil {
+		return nil, err
+	}
+
+	s.pepperSvc.AddKey(key)
+	if err := s.pepperSvc.SetCurrentKey(key.Id); err != nil {
+		return nil, err
+	}
+	s.currentKeyFile = keyFile
+
+	s.logger.Infof("pepper key rotation %s -> %s started", rotation.FromKeyId, rotation.ToKeyId)
+
+	s.running = true
+	go s.run(rotation)
+
+	return rotation, nil
+}
+
+// Resume brings the pepper keys in line with the last rotation, the config
+// may still point to the old key file. An unfinished rotation continues in
+// the background.
+func (s *rotationService) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rotation, err := s.repository.GetLastKeyRotation(context.Background())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+
+		return err
+	}
+
+	if rotation.ToKeyId != s.pepperSvc.CurrentKeyId() {
+		if err := s.loadKey(rotation.ToKeyId, rotation.ToKeyFile); err != nil {
+			return err
+		}
+
+		if err := s.pepperSvc.SetCurrentKey(rotation.ToKeyId); err != nil {
+			return err
+		}
+	}
+	s.currentKeyFile = rotation.ToKeyFile
+
+	if rotation.Status == RotationDone {
+		// Only fails if the retired key is not loaded at all.
+		_ = s.pepperSvc.RemoveKey(rotation.FromKeyId)
+		return nil
+	}
+
+	if err := s.loadKey(rotation.FromKeyId, rotation.FromKeyFile); err != nil {
+		return err
+	}
+
+	s.logger.Infof("pepper key rotation %s -> %s resumed at pass %d", rotation.FromKeyId, rotation.ToKeyId, rotation.Pass)
+
+	s.running = true
+	go s.run(rotation)
+
+	return nil
+}
+
+func (s *rotationService) Status() (*KeyRotation, error) {
+	return s.repository.GetLastKeyRotation(context.Background())
+}
+
+func (s *rotationService) loadKey(id, keyFile string) error {
+	key, err := crypto.LoadPepperKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if key.Id != id {
+		return fmt.Errorf("pepper key file %s holds key %s, expected %s", keyFile, key.Id, id)
+	}
+
+	s.pepperSvc.AddKey(key)
+
+	return nil
+}
+
+func (s *rotationService) run(rotation *KeyRotation) {
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	ctx := context.Background()
+
+	// retry logs err and waits before the next attempt. After too many
+	// failures in a row it gives up, the rotation stays running and
+	// continues when the bot restarts.
+	failures := 0
+	retry := func(err error) bool {
+		failures += 1
+		s.logger.Errorf("key rotation failed (attempt %d of %d): %s", failures, rotationMaxRetries, err)
+
+		if failures >= rotationMaxRetries {
+			s.logger.Errorf("pepper key rotation %s -> %s stopped, it continues when the bot restarts",
+				rotation.FromKeyId, rotation.ToKeyId)
+			return false
+		}
+
+		time.Sleep(rotationRetryDelay)
+		return true
+	}
+
+	for {
+		ids, err := s.repository.GetUserIdsAfter(ctx, rotation.LastUserId, rotationBatchSize)
+		if err != nil {
+			if !retry(err) {
+				return
+			}
+			continue
+		}
+
+		if len(ids) == 0 {
+			if rotation.PassChanged > 0 || rotation.PassUnreadable > 0 {
+				total, err := s.repository.CountUsers(ctx)
+				if err != nil {
+					if !retry(err) {
+						return
+					}
+					continue
+				}
+
+				// Something may have been written with the old key while
+				// we walked the users, make sure with another pass.
+				rotation.NextPass(total)
+				s.saveProgress(rotation)
+
+				// Values that can't be opened won't open on the next pass
+				// either. The old key has to stay until they are fixed.
+				if rotation.Unreadable > 0 {
+					s.logger.Errorf("pepper key rotation %s -> %s stopped, %d stored values can't be opened. "+
+						"Key %s stays in use, the rotation continues when the bot restarts",
+						rotation.FromKeyId, rotation.ToKeyId, rotation.Unreadable, rotation.FromKeyId)
+					return
+				}
+				continue
+			}
+
+			remaining, err := s.repository.CountSealedWith(ctx, crypto.PepperKeyPrefix(rotation.FromKeyId))
+			if err != nil {
+				if !retry(err) {
+					return
+				}
+				continue
+			}
+
+			// The walk only reaches data of existing users, whatever is
+			// left here belongs to none of them.
+			if remaining > 0 {
+				s.logger.Errorf("pepper key rotation %s -> %s stopped, %d records are still sealed with key %s. "+
+					"It stays in use, the rotation continues when the bot restarts",
+					rotation.FromKeyId, rotation.ToKeyId, remaining, rotation.FromKeyId)
+				return
+			}
+
+			if err := s.pepperSvc.RemoveKey(rotation.FromKeyId); err != nil {
+				s.logger.Errorf("failed to retire pepper key %s: %s", rotation.FromKeyId, err)
+			}
+
+			rotation.Finish()
+			s.saveProgress(rotation)
+
+			s.logger.Infof("pepper key rotation %s -> %s finished, key %s is retired. Set PEPPER_KEY_FILE to %s",
+				rotation.FromKeyId, rotation.ToKeyId, rotation.FromKeyId, rotation.ToKeyFile)
+			return
+		}
+
+		for _, id := range ids {
+			var (
+				changed    bool
+				unreadable int64
+			)
+			changed, unreadable, err = s.resealUser(ctx, id)
+			if err != nil {
+				err = fmt.Errorf("failed to reseal user %s: %w", id.Hex(), err)
+				break
+			}
+
+			if unreadable > 0 {
+				s.logger.Errorf("%d values of user %s can't be opened, they stay sealed as they are", unreadable, id.Hex())
+			}
+
+			rotation.Checkpoint(id, changed, unreadable)
+			failures = 0
+		}
+
+		s.saveProgress(rotation)
+
+		if err != nil && !retry(err) {
+			return
+		}
+	}
+}
+
+// resealUser reseals everything stored for the user with id. It returns
+// whether anything changed and the number of values it couldn't open.
+func (s *rotationService) resealUser(ctx context.Context, id primitive.ObjectID) (bool, int64, error) {
+	var (
+		telegramId int64
+		unreadable int64
+	)
+	changed, err := s.repository.ModifyUser(ctx, id, func(user *User) (bool, error) {
+		telegramId = user.TelegramId
+
+		changed, skipped, err := s.reseal(user)
+		unreadable = skipped
+
+		return changed, err
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	entriesChanged, entriesUnreadable, err := s.resealEntries(ctx, telegramId)
+	if err != nil {
+		return false, 0, err
+	}
+	unreadable += entriesUnreadable
+
+	attachmentsChanged, attachmentsUnreadable, err := s.resealAttachments(ctx, telegramId)
+	if err != nil {
+		return false, 0, err
+	}
+	unreadable += attachmentsUnreadable
+
+	return changed || entriesChanged || attachmentsChanged, unreadable, nil
+}
+
+// resealer reseals values one by one. A value it can't open is counted and
+// kept as it is, so it doesn't hold back the others. Any other error is
+// kept in err.
+type resealer struct {
+	svc        *rotationService
+	changed    bool
+	unreadable int64
+	err        error
+}
+
+// reseal returns stored sealed with the current key, or stored itself if
+// it can't.
+func (r *resealer) reseal(stored string) string {
+	if r.err != nil {
+		return stored
+	}
+
+	resealed, ok, err := r.svc.resealValue(stored)
+	if errors.Is(err, errUnreadableValue) {
+		r.unreadable += 1
+		return stored
+	}
+	if err != nil {
+		r.err = err
+		return stored
+	}
+
+	if ok {
+		r.changed = true
+		return resealed
+	}
+
+	return stored
+}
+
+// reseal moves every value of user that isn't sealed with the current key
+// to it. It returns whether anything changed and the number of values it
+// couldn't open.
+func (s *rotationService) reseal(user *User) (bool, int64, error) {
+	r := &resealer{svc: s}
+
+	if user.Vault != nil {
+		user.Vault.WrappedKey = r.reseal(user.Vault.WrappedKey)
+
+		for i, recoveryKey := range user.Vault.RecoveryKeys {
+			user.Vault.RecoveryKeys[i] = r.reseal(recoveryKey)
+		}
+
+		if user.Vault.Shares != nil {
+			user.Vault.Shares.WrappedKey = r.reseal(user.Vault.Shares.WrappedKey)
+		}
+	}
+
+	return r.changed, r.unreadable, r.err
+}
+
+// resealEntries does the same for the payloads and the history of the
+// entries of the user.
+func (s *rotationService) resealEntries(ctx context.Context, telegramId int64) (bool, int64, error) {
+	records, err := s.repository.GetEntries(ctx, telegramId)
+	if err != nil {
+		return false, 0, err
+	}
+
+	changed, unreadable := false, int64(0)
+	for i := range records {
+		record := &records[i]
+		previousPayload := record.Payload
+
+		r := &resealer{svc: s}
+		record.Payload = r.reseal(record.Payload)
+		for j := range record.History {
+			record.History[j].Payload = r.reseal(record.History[j].Payload)
+		}
+
+		unreadable += r.unreadable
+		if r.err != nil {
+			return changed, unreadable, r.err
+		}
+
+		if !r.changed {
+			continue
+		}
+
+		if _, err := s.repository.SwapEntryPayloads(ctx, record, previousPayload); err != nil {
+			return changed, unreadable, err
+		}
+
+		// Counts even if the entry was written in between, that write may
+		// have moved a payload with the old key to the history, so another
+		// pass has to look at it.
+		changed = true
+	}
+
+	return changed, unreadable, nil
+}
+
+// resealAttachments does the same for the names of the attachments of the
+// user. Their content is encrypted with the vault key and doesn't change.
+func (s *rotationService) resealAttachments(ctx context.Context, telegramId int64) (bool, int64, error) {
+	attachments, err := s.repository.GetAttachments(ctx, telegramId, primitive.NilObjectID)
+	if err != nil {
+		return false, 0, err
+	}
+
+	r := &resealer{svc: s}
+	changed := false
+	for i := range attachments {
+		attachment := &attachments[i]
+		previousName := attachment.Name
+
+		attachment.Name = r.reseal(attachment.Name)
+		if r.err != nil {
+			return changed, r.unreadable, r.err
+		}
+
+		if attachment.Name == previousName {
+			continue
+		}
+
+		if _, err := s.repository.SwapAttachmentName(ctx, attachment, previousName); err != nil {
+			return changed, r.unreadable, err
+		}
+
+		changed = true
+	}
+
+	return changed, r.unreadable, nil
+}
+
+func (s *rotationService) resealValue(stored string) (string, bool, error) {
+	if keyId, ok := s.pepperSvc.KeyId(stored); ok && keyId == s.pepperSvc.CurrentKeyId() {
+		return "", false, nil
+	}
+
+	data, err := s.pepperSvc.Open(stored)
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s", errUnreadableValue, err)
+	}
+
+	resealed, err := s.pepperSvc.Seal(data)
+	if err != nil {
+		return "", false, err
+	}
+
+	return resealed, true, nil
+}
+
+func (s *rotationService) saveProgress(rotation *KeyRotation) {
+	if err := s.repository.UpdateKeyRotation(context.Background(), rotation); err != nil {
+		s.logger.Errorf("failed to save key rotation progress: %s", err)
+	}
+}
@@ -1,75 +1,156 @@
 package bot
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
+	"password-guard-bot/pkg/breach"
 	"password-guard-bot/pkg/crypto"
-	"strings"
+	"password-guard-bot/pkg/fuzzy"
+	"password-guard-bot/pkg/generator"
+	"password-guard-bot/pkg/secret"
+	"password-guard-bot/pkg/strength"
+	"password-guard-bot/pkg/totp"
+	"sort"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
+// ErrWrongRecoveryCode is returned when a recovery code doesn't open the
+// vault, or was already used.
+var ErrWrongRecoveryCode = errors.New("wrong recovery code")
+
+const (
+	// findBatchSize is how many entry names FindEntries reads at once,
+	// findResults how many of the best matches it returns.
+	findBatchSize = 100
+	findResults   = 9
+
+	recoveryCodeCount  = 8
+	recoveryCodeLength = 16
+
+	// Crockford's base32, without I, L, O and U.
+	recoveryCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
 type Service interface {
 	CheckDuplicateFromWhatData(user UserState, chatId int64, from string) (bool, error)
 	CheckExistUser(chatId int64) (bool, error)
 
-	GetUserData(chatId int64) (map[string]string, error)
-	GetUserDataNamesByChunks(chatId int64, page int) ([][]tgbotapi.InlineKeyboardButton, error)
+	GetUserDataNamesByChunks(chatId int64, group *EntryGroup, page int) ([][]tgbotapi.InlineKeyboardButton, error)
+	GetEntryGroups(chatId int64) ([]EntryGroup, error)
+	GetEntryDetails(chatId int64, id primitive.ObjectID) (*Entry, error)
+	FindEntries(chatId int64, query string) ([][]tgbotapi.InlineKeyboardButton, error)
 
 	CreateUser(chatId int64) error
 
 	UpdateUser(chatId int64, user User) error
-	UpdateUserEncryptedData(chatId int64, fromWhat, encryptedData string) error
 
-	DeleteData(chatId int64, what string) error
+	DeleteEntry(chatId int64, id primitive.ObjectID) error
+	ToggleFavorite(chatId int64, id primitive.ObjectID) (bool, error)
+	RecordEntryAccess(chatId int64, id primitive.ObjectID) error
+
+	GetSettings(chatId int64) (UserSettings, error)
+	UpdateEntryOrder(chatId int64, order string) error
+
+	SaveEntry(chatId int64, pin secret.Secret, entry *Entry) error
+	GetEntry(chatId int64, pin secret.Secret, id primitive.ObjectID) (*Entry, error)
+	PeekEntry(chatId int64, pin secret.Secret, id primitive.ObjectID) (*Entry, error)
+
+	GetEntryVersionButtons(chatId int64, id primitive.ObjectID) ([][]tgbotapi.InlineKeyboardButton, error)
+	GetEntryVersion(chatId int64, pin secret.Secret, id primitive.ObjectID, version int) (*Entry, error)
+	RestoreEntryVersion(chatId int64, pin secret.Secret, id primitive.ObjectID, version int) error
 
-	EncryptData(chatId int64, userState UserState) (*string, error)
-	DecryptData(chatId int64, pin, fromWhat string) (*string, error)
+	SaveAttachment(chatId int64, pin secret.Secret, entryId primitive.ObjectID, name string, src io.Reader) error
+	GetAttachmentButtons(chatId int64, pin secret.Secret, entryId primitive.ObjectID) ([][]tgbotapi.InlineKeyboardButton, error)
+	OpenAttachment(chatId int64, pin secret.Secret, id primitive.ObjectID) (string, io.ReadCloser, error)
+
+	HasVault(chatId int64) (bool, error)
+	UnlockVault(chatId int64, pin secret.Secret) (bool, error)
+	ChangePin(chatId int64, oldPin, newPin secret.Secret) (int, error)
+
+	CountRecoveryCodes(chatId int64) (int, error)
+	GenerateRecoveryCodes(chatId int64, pin secret.Secret) ([]secret.Secret, error)
+	CheckRecoveryCode(chatId int64, code secret.Secret) error
+	RecoverVault(chatId int64, code, newPin secret.Secret) (int, error)
+
+	GetShareThreshold(chatId int64) (int, error)
+	SplitVaultKey(chatId int64, pin secret.Secret, count, threshold int) (*ShareSet, []secret.Secret, error)
+	CheckShares(chatId int64, shares []secret.Secret) (int, error)
+	RecoverVaultWithShares(chatId int64, shares []secret.Secret, newPin secret.Secret) error
+
+	GeneratePassword(options generator.Options) (string, error)
+	EstimatePasswordStrength(userState UserState) strength.Result
+	CountPasswordBreaches(userState UserState) int
+
+	GetUserOtpNamesByChunks(chatId int64, page int) ([][]tgbotapi.InlineKeyboardButton, error)
+	CheckDuplicateOtpName(chatId int64, name string) (bool, error)
+	SaveOtp(chatId int64, pin secret.Secret, name string, otpSecret secret.Secret) error
+	GetOtpCode(chatId int64, pin secret.Secret, id primitive.ObjectID) (string, string, int, error)
 }
 
 type service struct {
-	botApi     *tgbotapi.BotAPI
-	cryptoSvc  crypto.CryptoService
-	repository Repository
-	logger     *zap.SugaredLogger
+	botApi       *tgbotapi.BotAPI
+	cryptoSvc    crypto.CryptoService
+	pepperSvc    crypto.PepperService
+	generator    generator.Generator
+	estimator    strength.Estimator
+	breaches     breach.Checker
+	repository   Repository
+	historyDepth int
+	logger       *zap.SugaredLogger
 }
 
-func NewService(botApi *tgbotapi.BotAPI, cryptoSvc crypto.CryptoService, repository Repository, logger *zap.SugaredLogger) (Service, error) {
+func NewService(botApi *tgbotapi.BotAPI, cryptoSvc crypto.CryptoService, pepperSvc crypto.PepperService, generator generator.Generator, estimator strength.Estimator, breaches breach.Checker, repository Repository, historyDepth int, logger *zap.SugaredLogger) (Service, error) {
 	if botApi == nil {
 		return nil, errors.New("invalid telegram bot api")
 	}
 	if cryptoSvc == nil {
 		return nil, errors.New("invalid crypto service")
 	}
+	if pepperSvc == nil {
+		return nil, errors.New("invalid pepper service")
+	}
+	if generator == nil {
+		return nil, errors.New("invalid generator")
+	}
+	if estimator == nil {
+		return nil, errors.New("invalid strength estimator")
+	}
+	if breaches == nil {
+		return nil, errors.New("invalid breach checker")
+	}
 	if repository == nil {
 		return nil, errors.New("invalid repository")
 	}
+	if historyDepth < 0 {
+		return nil, errors.New("invalid history depth")
+	}
 	if logger == nil {
 		return nil, errors.New("invalid logger")
 	}
 
-	return &service{botApi: botApi, cryptoSvc: cryptoSvc, repository: repository, logger: logger}, nil
+	return &service{botApi: botApi, cryptoSvc: cryptoSvc, pepperSvc: pepperSvc, generator: generator, estimator: estimator, breaches: breaches, repository: repository, historyDepth: historyDepth, logger: logger}, nil
 }
 
 func (s *service) CheckDuplicateFromWhatData(user UserState, chatId int64, from string) (bool, error) {
-	dbUser, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
-	if err != nil {
-		return false, err
-	}
-
-	if dbUser.Data == nil {
-		return false, nil
-	}
+	if _, err := s.repository.GetEntryByName(context.Background(), chatId, from); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
 
-	if _, ok := (*dbUser.Data)[from]; ok {
-		return true, nil
+		return false, err
 	}
 
-	return false, nil
+	return true, nil
 }
 
 func (s *service) CheckExistUser(chatId int64) (bool, error) {
@@ -85,41 +166,147 @@ func (s *service) CheckExistUser(chatId int64) (bool, error) {
 	return true, nil
 }
 
-func (s *service) GetUserData(chatId int64) (map[string]string, error) {
-	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+// GetUserDataNamesByChunks lists one page of the entries in group, or of all
+// entries if group is nil, in the order the user picked.
+func (s *service) GetUserDataNamesByChunks(chatId int64, group *EntryGroup, page int) ([][]tgbotapi.InlineKeyboardButton, error) {
+	settings, err := s.GetSettings(chatId)
 	if err != nil {
 		return nil, err
 	}
 
-	return (*user.Data), nil
+	records, size, err := s.repository.GetEntriesPage(context.Background(), chatId, group, settings.EntryOrder, page)
+	if err != nil {
+		return nil, err
+	}
+
+	// The id keeps callback data short and free of any character the name
+	// may contain.
+	buttons := make([]tgbotapi.InlineKeyboardButton, 0, len(records))
+	for _, record := range records {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(record.label(), record.ID.Hex()))
+	}
+
+	return nameChunks(buttons, int(size), page), nil
+}
+
+// GetEntryGroups returns the folders and tags to pick entries from, nil if
+// the user doesn't use any.
+func (s *service) GetEntryGroups(chatId int64) ([]EntryGroup, error) {
+	return s.repository.GetEntryGroups(context.Background(), chatId)
+}
+
+// GetEntryDetails returns the entry with only the fields that are stored in
+// the clear, no pin is needed for them.
+func (s *service) GetEntryDetails(chatId int64, id primitive.ObjectID) (*Entry, error) {
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.details(), nil
+}
+
+// FindEntries returns the entries whose names best match query, best first.
+// It returns nil if none match.
+func (s *service) FindEntries(chatId int64, query string) ([][]tgbotapi.InlineKeyboardButton, error) {
+	type match struct {
+		record EntryRecord
+		score  int
+	}
+
+	var matches []match
+	after := primitive.NilObjectID
+	for {
+		records, err := s.repository.GetEntryNamesAfter(context.Background(), chatId, after, findBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) == 0 {
+			break
+		}
+		after = records[len(records)-1].ID
+
+		for _, record := range records {
+			if score, ok := fuzzy.Match(query, record.Name); ok {
+				matches = append(matches, match{record: record, score: score})
+			}
+		}
+
+		// Only the best results are kept between batches.
+		sort.SliceStable(matches, func(i, j int) bool {
+			if matches[i].score != matches[j].score {
+				return matches[i].score > matches[j].score
+			}
+
+			return matches[i].record.Name < matches[j].record.Name
+		})
+		if len(matches) > findResults {
+			matches = matches[:findResults]
+		}
+	}
+
+	buttons := make([]tgbotapi.InlineKeyboardButton, 0, len(matches))
+	for _, match := range matches {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(match.record.label(), match.record.ID.Hex()))
+	}
+
+	return nameChunks(buttons, len(buttons), 1), nil
 }
 
-func (s *service) GetUserDataNamesByChunks(chatId int64, page int) ([][]tgbotapi.InlineKeyboardButton, error) {
-	user, dataSize, err := s.repository.GetUserWithSliceAndDataSize(context.Background(), bson.M{"telegram_id": chatId}, page)
+// GetUserOtpNamesByChunks lists one page of the one-time code secrets, by
+// name. Like the entry pickers, the buttons carry the id.
+func (s *service) GetUserOtpNamesByChunks(chatId int64, page int) ([][]tgbotapi.InlineKeyboardButton, error) {
+	records, size, err := s.repository.GetOtpEntriesPage(context.Background(), chatId, page)
 	if err != nil {
 		return nil, err
 	}
 
-	if user.Data == nil || len(*user.Data) == 0 {
-		return nil, nil
+	buttons := make([]tgbotapi.InlineKeyboardButton, 0, len(records))
+	for _, record := range records {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(record.Name, record.ID.Hex()))
+	}
+
+	return nameChunks(buttons, int(size), page), nil
+}
+
+// groupChunks lays out one page of groups like nameChunks, the callback
+// data is the index into groups.
+func groupChunks(groups []EntryGroup, page int) [][]tgbotapi.InlineKeyboardButton {
+	start := min((page-1)*9, len(groups))
+	end := min(start+9, len(groups))
+
+	buttons := make([]tgbotapi.InlineKeyboardButton, 0, end-start)
+	for i := start; i < end; i++ {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(groups[i].Label(), fmt.Sprintf("group-%d", i)))
+	}
+
+	return nameChunks(buttons, len(groups), page)
+}
+
+// nameChunks lays out one page of buttons as keyboard rows of three, with
+// pagination buttons below.
+func nameChunks(names []tgbotapi.InlineKeyboardButton, size, page int) [][]tgbotapi.InlineKeyboardButton {
+	if len(names) == 0 {
+		return nil
 	}
 
 	var chunks [][]tgbotapi.InlineKeyboardButton
 	var chunk []tgbotapi.InlineKeyboardButton
 
-	for k := range *user.Data {
+	for _, button := range names {
 		if len(chunk) == 3 {
 			chunks = append(chunks, chunk)
 			chunk = nil
 		}
-		chunk = append(chunk, tgbotapi.NewInlineKeyboardButtonData(k, k))
+		chunk = append(chunk, button)
 	}
 
 	var buttons []tgbotapi.InlineKeyboardButton
 	if page > 1 {
 		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData("< Prev", "prev"))
 	}
-	if len(*user.Data) == 9 && len(*user.Data) != *dataSize {
+	if len(names) == 9 && len(names) != size {
 		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData("Next >", "next"))
 	}
 
@@ -129,7 +316,7 @@ func (s *service) GetUserDataNamesByChunks(chatId int64, page int) ([][]tgbotapi
 		chunks = append(chunks, buttons)
 	}
 
-	return chunks, nil
+	return chunks
 }
 
 func (s *service) CreateUser(chatId int64) error {
@@ -156,66 +343,979 @@ func (s *service) UpdateUser(chatId int64, user User) error {
 	return nil
 }
 
-func (s *service) UpdateUserEncryptedData(chatId int64, fromWhat, encryptedData string) error {
+// DeleteEntry deletes the entry together with its attachments.
+func (s *service) DeleteEntry(chatId int64, id primitive.ObjectID) error {
+	if err := s.repository.DeleteEntry(context.Background(), chatId, id); err != nil {
+		return err
+	}
+
+	return s.repository.DeleteAttachments(context.Background(), chatId, id)
+}
+
+// ToggleFavorite adds the entry to the favorites or removes it, it reports
+// whether the entry is a favorite now.
+func (s *service) ToggleFavorite(chatId int64, id primitive.ObjectID) (bool, error) {
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.repository.SetEntryFavorite(context.Background(), chatId, id, !record.Favorite); err != nil {
+		return false, err
+	}
+
+	return !record.Favorite, nil
+}
+
+// RecordEntryAccess counts a decryption of the entry, for sorting by use.
+func (s *service) RecordEntryAccess(chatId int64, id primitive.ObjectID) error {
+	return s.repository.RecordEntryAccess(context.Background(), chatId, id, time.Now())
+}
+
+// GetSettings returns the settings of the user, the defaults if there are
+// none yet.
+func (s *service) GetSettings(chatId int64) (UserSettings, error) {
 	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
 	if err != nil {
-		return err
+		return UserSettings{}, err
+	}
+
+	if user.Settings == nil {
+		return UserSettings{}, nil
 	}
 
-	user.AddData(fromWhat, encryptedData)
+	return *user.Settings, nil
+}
 
-	err = s.repository.UpdateUser(context.Background(), user)
+func (s *service) UpdateEntryOrder(chatId int64, order string) error {
+	switch order {
+	case entryOrderName, entryOrderRecent, entryOrderFrequent:
+	default:
+		return fmt.Errorf("unknown entry order %q", order)
+	}
+
+	settings, err := s.GetSettings(chatId)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	settings.EntryOrder = order
+
+	return s.repository.UpdateSettings(context.Background(), chatId, &settings)
 }
 
-func (s *service) DeleteData(chatId int64, what string) error {
+// SaveEntry encrypts entry with the vault key and stores it. An entry with
+// an id is updated, otherwise it replaces the entry with the same name or
+// is added. A replaced payload is kept in the history. The vault is created
+// with pin if the user doesn't have one yet.
+func (s *service) SaveEntry(chatId int64, pin secret.Secret, entry *Entry) error {
 	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
 	if err != nil {
 		return err
 	}
 
-	user.DeleteData(what)
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
 
-	err = s.repository.UpdateUser(context.Background(), user)
+	key, err := s.openVault(user, normalizePin)
 	if err != nil {
 		return err
 	}
+	defer key.Wipe()
 
-	return nil
+	payload := entry.marshal()
+	defer payload.Wipe()
+
+	encryptedData, err := s.encryptWithKey(key, payload)
+	if err != nil {
+		return err
+	}
+
+	var record *EntryRecord
+	if !entry.ID.IsZero() {
+		record, err = s.repository.GetEntry(context.Background(), chatId, entry.ID)
+	} else {
+		record, err = s.repository.GetEntryByName(context.Background(), chatId, entry.Name)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if record != nil {
+		record.pushVersion(s.historyDepth)
+		record.Type = entry.Type
+		record.Folder = entry.Folder
+		record.Tags = entry.Tags
+		record.Payload = encryptedData
+		record.Format = entryFormatFields
+		record.UpdatedAt = time.Now()
+
+		return s.repository.UpdateEntry(context.Background(), record)
+	}
+
+	if !entry.ID.IsZero() {
+		return mongo.ErrNoDocuments
+	}
+
+	now := time.Now()
+	record = &EntryRecord{
+		ID:         primitive.NewObjectID(),
+		TelegramId: chatId,
+		Name:       entry.Name,
+		Type:       entry.Type,
+		Folder:     entry.Folder,
+		Tags:       entry.Tags,
+		Payload:    encryptedData,
+		Format:     entryFormatFields,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	return s.repository.UpsertEntry(context.Background(), record)
 }
 
-func (s *service) EncryptData(chatId int64, userState UserState) (*string, error) {
-	rawData := fmt.Sprintf("%s:%s", strings.TrimSpace(userState.Login), strings.TrimSpace(userState.Password))
-	encryptedData, err := s.cryptoSvc.Encrypt(s.cryptoSvc.GenerateNormalSizeCode(strings.TrimSpace(userState.Pin)), []byte(rawData))
+// GetEntry decrypts the entry for /dec, the caller wipes it. The access is
+// recorded, the usage of entry is the one from before it.
+func (s *service) GetEntry(chatId int64, pin secret.Secret, id primitive.ObjectID) (*Entry, error) {
+	entry, err := s.PeekEntry(chatId, pin, id)
 	if err != nil {
-		s.logger.Errorf("failed to encrypt data: %s", err)
 		return nil, err
 	}
 
-	return &encryptedData, nil
+	// A failure only loses the count, the repository logged it.
+	_ = s.RecordEntryAccess(chatId, id)
 
+	return entry, nil
 }
 
-func (s *service) DecryptData(chatId int64, pin, fromWhat string) (*string, error) {
+// PeekEntry decrypts the entry without recording an access, to update it or
+// to reveal what GetEntry left hidden. The caller wipes it. Entries in an
+// older format or encryption are rewritten on the way.
+func (s *service) PeekEntry(chatId int64, pin secret.Secret, id primitive.ObjectID) (*Entry, error) {
 	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
 	if err != nil {
 		return nil, err
 	}
 
-	data := (*user.Data)[fromWhat]
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
 
-	normalizePin := s.cryptoSvc.GenerateNormalSizeCode(strings.TrimSpace(pin))
-	decrypted, err := s.cryptoSvc.Decrypt([]byte(normalizePin), data)
+	entry, data, err := s.decryptRecord(user, normalizePin, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cryptoSvc.NeedsPin(data) || record.Format != entryFormatFields || s.needsSeal(record.Payload) {
+		s.upgradeEntry(user, normalizePin, *record, data, entry)
+	}
+
+	return entry, nil
+}
+
+// GetEntryVersionButtons lists the history of the entry, newest first. It
+// returns nil if there is none.
+func (s *service) GetEntryVersionButtons(chatId int64, id primitive.ObjectID) ([][]tgbotapi.InlineKeyboardButton, error) {
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, version := range record.History {
+		label := fmt.Sprintf("🕓 %s", version.UpdatedAt.UTC().Format("2006-01-02 15:04 UTC"))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("version-%d", i))))
+	}
+
+	return rows, nil
+}
+
+// GetEntryVersion decrypts version of the history of the entry, the caller
+// wipes it. The access is recorded on the entry.
+func (s *service) GetEntryVersion(chatId int64, pin secret.Secret, id primitive.ObjectID, version int) (*Entry, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
 	if err != nil {
-		s.logger.Errorf("failed to decrypt data: %s", err)
 		return nil, err
 	}
 
-	replacedDec := strings.Replace(decrypted, "\n", " ", -1)
+	versionRecord, err := record.version(version)
+	if err != nil {
+		return nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	entry, _, err := s.decryptRecord(user, normalizePin, versionRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failure only loses the count, the repository logged it.
+	_ = s.RecordEntryAccess(chatId, id)
+
+	return entry, nil
+}
+
+// RestoreEntryVersion makes version of the history the current payload and
+// type of the entry, the current ones go to the front of the history
+// instead.
+func (s *service) RestoreEntryVersion(chatId int64, pin secret.Secret, id primitive.ObjectID, version int) error {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return err
+	}
+
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return err
+	}
+
+	versionRecord, err := record.version(version)
+	if err != nil {
+		return err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	// Decrypting checks the pin, and a version from before the vault is
+	// stored again under the vault key.
+	entry, _, err := s.decryptRecord(user, normalizePin, versionRecord)
+	if err != nil {
+		return err
+	}
+	defer entry.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizePin)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+
+	payload := entry.marshal()
+	defer payload.Wipe()
+
+	encryptedData, err := s.encryptWithKey(key, payload)
+	if err != nil {
+		return err
+	}
+
+	record.History = append(record.History[:version:version], record.History[version+1:]...)
+	record.pushVersion(s.historyDepth)
+	record.Type = versionRecord.Type
+	record.Payload = encryptedData
+	record.Format = entryFormatFields
+	record.UpdatedAt = time.Now()
+
+	return s.repository.UpdateEntry(context.Background(), record)
+}
+
+func (s *service) HasVault(chatId int64) (bool, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return false, err
+	}
 
-	return &replacedDec, nil
+	return user.Vault != nil, nil
+}
+
+// UnlockVault checks the pin against the user's vault, the vault is
+// created with this pin if the user doesn't have one yet. It reports
+// whether the vault was created.
+func (s *service) UnlockVault(chatId int64, pin secret.Secret) (bool, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return false, err
+	}
+
+	created := user.Vault == nil
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.openVault(user, normalizePin)
+	if err != nil {
+		return false, err
+	}
+	key.Wipe()
+
+	return created, nil
+}
+
+// ChangePin wraps the vault key with newPin. It returns the number of
+// entries from before the vault that oldPin doesn't open. They keep the
+// pin they were saved with, the new one doesn't open them.
+func (s *service) ChangePin(chatId int64, oldPin, newPin secret.Secret) (int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return 0, err
+	}
+
+	normalizeOldPin := oldPin.TrimSpace()
+	defer normalizeOldPin.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizeOldPin)
+	if err != nil {
+		return 0, err
+	}
+	defer key.Wipe()
+
+	records, err := s.repository.GetEntries(context.Background(), chatId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Entries and versions still encrypted with the old pin itself would
+	// not follow the new one, move them under the vault key first. The vault
+	// key stays the same, so they are readable whether or not the pin change
+	// goes through.
+	skipped := 0
+	for i := range records {
+		record := &records[i]
+
+		encryptedData, changed, err := s.moveUnderKey(key, normalizeOldPin, record)
+		stuck := errors.Is(err, errOtherPin)
+		if err != nil && !stuck {
+			return 0, err
+		}
+
+		if changed {
+			record.Payload = encryptedData
+			record.Format = entryFormatFields
+		}
+
+		for j := range record.History {
+			versionRecord, _ := record.version(j)
+
+			encryptedData, ok, err := s.moveUnderKey(key, normalizeOldPin, versionRecord)
+			if errors.Is(err, errOtherPin) {
+				stuck = true
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+
+			if ok {
+				record.History[j].Payload = encryptedData
+				record.History[j].Format = entryFormatFields
+				changed = true
+			}
+		}
+
+		if stuck {
+			skipped++
+		}
+
+		if !changed {
+			continue
+		}
+
+		if err := s.repository.UpdateEntry(context.Background(), record); err != nil {
+			return 0, err
+		}
+	}
+
+	normalizeNewPin := newPin.TrimSpace()
+	defer normalizeNewPin.Wipe()
+
+	wrappedKey, err := s.wrapKey(normalizeNewPin, key)
+	if err != nil {
+		return 0, err
+	}
+
+	previousWrappedKey := user.Vault.WrappedKey
+	user.SetWrappedKey(wrappedKey)
+
+	if err := s.repository.SwapVault(context.Background(), user, previousWrappedKey); err != nil {
+		return 0, err
+	}
+
+	return skipped, nil
+}
+
+func (s *service) CountRecoveryCodes(chatId int64) (int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return 0, err
+	}
+
+	if user.Vault == nil {
+		return 0, nil
+	}
+
+	return len(user.Vault.RecoveryKeys), nil
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with new ones.
+// Every code wraps the vault key on its own, the caller shows them once and
+// wipes them. The codes are random, so they skip the costly key derivation
+// a pin needs.
+func (s *service) GenerateRecoveryCodes(chatId int64, pin secret.Secret) ([]secret.Secret, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizePin)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+
+	codes := make([]secret.Secret, 0, recoveryCodeCount)
+	recoveryKeys := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			s.logger.Errorf("failed to generate recovery code: %s", err)
+			wipeAll(codes)
+			return nil, err
+		}
+		codes = append(codes, code)
+
+		wrappedKey, err := s.wrapRecoveryKey(code, key)
+		if err != nil {
+			wipeAll(codes)
+			return nil, err
+		}
+		recoveryKeys = append(recoveryKeys, wrappedKey)
+	}
+
+	user.SetRecoveryKeys(recoveryKeys)
+
+	if err := s.repository.SwapVault(context.Background(), user, user.Vault.WrappedKey); err != nil {
+		wipeAll(codes)
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// CheckRecoveryCode returns ErrWrongRecoveryCode unless code is one of the
+// user's unused recovery codes.
+func (s *service) CheckRecoveryCode(chatId int64, code secret.Secret) error {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return err
+	}
+
+	_, key, err := s.unwrapRecoveryKey(user, code)
+	key.Wipe()
+
+	return err
+}
+
+// RecoverVault wraps the vault key with newPin using a recovery code
+// instead of the old pin, and uses up the code. It returns how many codes
+// are left.
+//
+// Entries from before the vault that are still encrypted with the old pin
+// itself can't be moved, they stay readable only with the old pin.
+func (s *service) RecoverVault(chatId int64, code, newPin secret.Secret) (int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return 0, err
+	}
+
+	i, key, err := s.unwrapRecoveryKey(user, code)
+	if err != nil {
+		return 0, err
+	}
+	defer key.Wipe()
+
+	normalizeNewPin := newPin.TrimSpace()
+	defer normalizeNewPin.Wipe()
+
+	wrappedKey, err := s.wrapKey(normalizeNewPin, key)
+	if err != nil {
+		return 0, err
+	}
+
+	previousWrappedKey := user.Vault.WrappedKey
+	user.SetWrappedKey(wrappedKey)
+	user.RemoveRecoveryKey(i)
+
+	if err := s.repository.SwapVault(context.Background(), user, previousWrappedKey); err != nil {
+		return 0, err
+	}
+
+	return len(user.Vault.RecoveryKeys), nil
+}
+
+func (s *service) GeneratePassword(options generator.Options) (string, error) {
+	password, err := s.generator.Generate(options)
+	if err != nil {
+		s.logger.Errorf("failed to generate password: %s", err)
+		return "", err
+	}
+
+	return password, nil
+}
+
+// EstimatePasswordStrength scores the password being stored, the login and
+// the entry name count as easy guesses.
+func (s *service) EstimatePasswordStrength(userState UserState) strength.Result {
+	return s.estimator.Estimate(string(bytes.TrimSpace(userState.Password.Bytes())), string(userState.Login.Bytes()), userState.From)
+}
+
+// CountPasswordBreaches returns how often the password being stored was
+// seen in breaches. A failing lookup is only logged, it must not keep the
+// user from saving.
+func (s *service) CountPasswordBreaches(userState UserState) int {
+	count, err := s.breaches.Count(bytes.TrimSpace(userState.Password.Bytes()))
+	if err != nil {
+		s.logger.Errorf("failed to check password breaches: %s", err)
+		return 0
+	}
+
+	return count
+}
+
+// CheckDuplicateOtpName reports whether name is taken. One-time code
+// secrets are entries, they share the names with the other entries.
+func (s *service) CheckDuplicateOtpName(chatId int64, name string) (bool, error) {
+	if _, err := s.repository.GetEntryByName(context.Background(), chatId, name); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SaveOtp stores a TOTP secret, an otpauth:// URI or a base32 secret, as an
+// entry named name. It returns totp.ErrInvalidSecret if the secret can't be
+// used to generate codes.
+func (s *service) SaveOtp(chatId int64, pin secret.Secret, name string, otpSecret secret.Secret) error {
+	normalizeSecret := otpSecret.TrimSpace()
+	defer normalizeSecret.Wipe()
+
+	if _, err := totp.Parse(string(normalizeSecret.Bytes())); err != nil {
+		return err
+	}
+
+	return s.SaveEntry(chatId, pin, &Entry{Name: name, Type: entryTypeOtp, Content: normalizeSecret})
+}
+
+// GetOtpCode returns the name of the one-time code secret with id, its
+// current code and the number of seconds the code stays valid.
+func (s *service) GetOtpCode(chatId int64, pin secret.Secret, id primitive.ObjectID) (string, string, int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	record, err := s.repository.GetEntry(context.Background(), chatId, id)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if record.Type != entryTypeOtp {
+		return "", "", 0, errNotOtp
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	entry, data, err := s.decryptRecord(user, normalizePin, record)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer entry.Wipe()
+
+	if record.Format != entryFormatFields || s.needsSeal(record.Payload) {
+		s.upgradeEntry(user, normalizePin, *record, data, entry)
+	}
+
+	otpKey, err := totp.Parse(string(entry.Content.Bytes()))
+	if err != nil {
+		s.logger.Errorf("failed to parse otp secret: %s", err)
+		return "", "", 0, err
+	}
+
+	code, remaining := otpKey.Code(time.Now())
+	secret.Wipe(otpKey.Secret)
+
+	return record.Name, code, remaining, nil
+}
+
+// openVault returns the vault key of user, creating the vault with pin if
+// the user doesn't have one yet.
+func (s *service) openVault(user *User, pin secret.Secret) (secret.Secret, error) {
+	if user.Vault != nil {
+		return s.unwrapVaultKey(user, pin)
+	}
+
+	key, err := s.cryptoSvc.GenerateKey()
+	if err != nil {
+		s.logger.Errorf("failed to generate vault key: %s", err)
+		return secret.Secret{}, err
+	}
+
+	wrappedKey, err := s.wrapKey(pin, key)
+	if err != nil {
+		key.Wipe()
+		return secret.Secret{}, err
+	}
+
+	user.SetWrappedKey(wrappedKey)
+
+	if err := s.repository.SwapVault(context.Background(), user, ""); err != nil {
+		key.Wipe()
+		return secret.Secret{}, err
+	}
+
+	return key, nil
+}
+
+func (s *service) unwrapVaultKey(user *User, pin secret.Secret) (secret.Secret, error) {
+	if user.Vault == nil {
+		return secret.Secret{}, errors.New("user has no vault")
+	}
+
+	wrappedKey, err := s.pepperSvc.Open(user.Vault.WrappedKey)
+	if err != nil {
+		s.logger.Errorf("failed to open pepper layer: %s", err)
+		return secret.Secret{}, err
+	}
+
+	key, err := s.cryptoSvc.UnwrapKey(pin, wrappedKey)
+	if err != nil {
+		if !errors.Is(err, crypto.ErrWrongPin) {
+			s.logger.Errorf("failed to unwrap vault key: %s", err)
+		}
+
+		return secret.Secret{}, err
+	}
+
+	// Vaults created before the pepper layer only need to be sealed.
+	if s.needsSeal(user.Vault.WrappedKey) {
+		s.sealVault(user, wrappedKey)
+	}
+
+	return key, nil
+}
+
+// unwrapRecoveryKey finds the recovery key that code opens and returns its
+// index with the vault key.
+func (s *service) unwrapRecoveryKey(user *User, code secret.Secret) (int, secret.Secret, error) {
+	if user.Vault == nil {
+		return 0, secret.Secret{}, ErrWrongRecoveryCode
+	}
+
+	normalizeCode := normalizeRecoveryCode(code)
+	defer normalizeCode.Wipe()
+
+	if normalizeCode.Len() != recoveryCodeLength {
+		return 0, secret.Secret{}, ErrWrongRecoveryCode
+	}
+
+	for i, recoveryKey := range user.Vault.RecoveryKeys {
+		wrappedKey, err := s.pepperSvc.Open(recoveryKey)
+		if err != nil {
+			s.logger.Errorf("failed to open pepper layer: %s", err)
+			continue
+		}
+
+		key, err := s.cryptoSvc.UnwrapKey(normalizeCode, wrappedKey)
+		if err != nil {
+			if !errors.Is(err, crypto.ErrWrongPin) {
+				s.logger.Errorf("failed to unwrap recovery key: %s", err)
+			}
+
+			continue
+		}
+
+		return i, key, nil
+	}
+
+	return 0, secret.Secret{}, ErrWrongRecoveryCode
+}
+
+// sealVault stores the wrapped key sealed with the current pepper key. A
+// failure is only logged, the vault stays readable as it was.
+func (s *service) sealVault(user *User, wrappedKey string) {
+	sealedKey, err := s.pepperSvc.Seal(wrappedKey)
+	if err != nil {
+		s.logger.Errorf("failed to seal vault key: %s", err)
+		return
+	}
+
+	previousWrappedKey := user.Vault.WrappedKey
+	user.SetWrappedKey(sealedKey)
+
+	if err := s.repository.SwapVault(context.Background(), user, previousWrappedKey); err != nil {
+		user.Vault.WrappedKey = previousWrappedKey
+	}
+}
+
+// decryptRecord decrypts and decodes the payload of record, with pin itself
+// or with the vault key. It also returns the payload without the pepper
+// layer.
+func (s *service) decryptRecord(user *User, pin secret.Secret, record *EntryRecord) (*Entry, string, error) {
+	data, err := s.pepperSvc.Open(record.Payload)
+	if err != nil {
+		s.logger.Errorf("failed to open pepper layer: %s", err)
+		return nil, "", err
+	}
+
+	var decrypted secret.Secret
+	if s.cryptoSvc.NeedsPin(data) {
+		decrypted, err = s.decryptWithPin(pin, data, record.Format)
+	} else {
+		var key secret.Secret
+		key, err = s.unwrapVaultKey(user, pin)
+		if err == nil {
+			decrypted, err = s.cryptoSvc.DecryptWithKey(key, data)
+			key.Wipe()
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, crypto.ErrWrongPin) {
+			return nil, "", err
+		}
+
+		s.logger.Errorf("failed to decrypt data: %s", err)
+		return nil, "", err
+	}
+	defer decrypted.Wipe()
+
+	entry, err := decodeEntry(record, decrypted.Bytes())
+	if err != nil {
+		s.logger.Errorf("failed to decode entry: %s", err)
+		return nil, "", err
+	}
+
+	return entry, data, nil
+}
+
+// errOtherPin is returned by moveUnderKey for a payload encrypted with a
+// pin other than the one given.
+var errOtherPin = errors.New("payload is encrypted with another pin")
+
+// moveUnderKey encrypts the payload of record with the vault key if it is
+// encrypted with pin itself. It reports false for anything else, and
+// errOtherPin for payloads pin doesn't open.
+func (s *service) moveUnderKey(key, pin secret.Secret, record *EntryRecord) (string, bool, error) {
+	data, err := s.pepperSvc.Open(record.Payload)
+	if err != nil || !s.cryptoSvc.NeedsPin(data) {
+		return "", false, nil
+	}
+
+	decrypted, err := s.decryptWithPin(pin, data, record.Format)
+	if err != nil {
+		return "", false, errOtherPin
+	}
+
+	entry, err := decodeEntry(record, decrypted.Bytes())
+	decrypted.Wipe()
+	if err != nil {
+		return "", false, errOtherPin
+	}
+
+	payload := entry.marshal()
+	entry.Wipe()
+
+	encryptedData, err := s.encryptWithKey(key, payload)
+	payload.Wipe()
+	if err != nil {
+		return "", false, err
+	}
+
+	return encryptedData, true, nil
+}
+
+// decryptWithPin opens data encrypted directly with a pin, from before the
+// vault existed.
+func (s *service) decryptWithPin(pin secret.Secret, data string, format int) (secret.Secret, error) {
+	decrypted, err := s.cryptoSvc.Decrypt(pin, data)
+	if err != nil {
+		return secret.Secret{}, err
+	}
+
+	// Legacy records have no integrity check, so garbage that happens to be
+	// valid UTF-8 is caught here by the "login:password" shape.
+	if format == entryFormatLegacy && !bytes.Contains(decrypted.Bytes(), []byte(":")) {
+		decrypted.Wipe()
+		return secret.Secret{}, crypto.ErrWrongPin
+	}
+
+	return decrypted, nil
+}
+
+// upgradeEntry stores an entry read from an older record again: a legacy
+// payload, data encrypted with the pin itself or missing the pepper layer.
+// It moves under the vault key if the pin also opens the vault, otherwise
+// it stays encrypted with the pin, at the current format and key
+// derivation cost. A failure here is not fatal for the caller, the old
+// record is still readable.
+func (s *service) upgradeEntry(user *User, pin secret.Secret, record EntryRecord, data string, entry *Entry) {
+	payload := entry.marshal()
+	defer payload.Wipe()
+
+	legacy := record.Format != entryFormatFields
+	record.Format = entryFormatFields
+
+	if key, err := s.unwrapVaultKey(user, pin); err == nil {
+		encryptedData, err := s.cryptoSvc.EncryptWithKey(key, payload)
+		key.Wipe()
+		if err != nil {
+			s.logger.Errorf("failed to upgrade encrypted data: %s", err)
+			return
+		}
+
+		s.saveEntryRecord(record, encryptedData)
+		return
+	}
+
+	if legacy || s.cryptoSvc.NeedsUpgrade(data) {
+		encryptedData, err := s.cryptoSvc.Encrypt(pin, payload)
+		if err != nil {
+			s.logger.Errorf("failed to upgrade encrypted data: %s", err)
+			return
+		}
+
+		s.saveEntryRecord(record, encryptedData)
+		return
+	}
+
+	if s.needsSeal(record.Payload) {
+		s.saveEntryRecord(record, data)
+	}
+}
+
+// saveEntryRecord seals data with the pepper layer and stores it as the
+// payload of record. Like upgradeEntry it only logs failures.
+func (s *service) saveEntryRecord(record EntryRecord, data string) {
+	sealedData, err := s.pepperSvc.Seal(data)
+	if err != nil {
+		s.logger.Errorf("failed to seal encrypted data: %s", err)
+		return
+	}
+
+	record.Payload = sealedData
+
+	if err := s.repository.UpdateEntry(context.Background(), &record); err != nil {
+		s.logger.Errorf("failed to save upgraded encrypted data: %s", err)
+	}
+}
+
+// needsSeal reports whether stored data is missing the pepper layer or
+// uses an older pepper key.
+func (s *service) needsSeal(stored string) bool {
+	keyId, ok := s.pepperSvc.KeyId(stored)
+
+	return !ok || keyId != s.pepperSvc.CurrentKeyId()
+}
+
+// encryptWithKey encrypts data with the vault key and seals it with the
+// pepper layer, ready to be stored.
+func (s *service) encryptWithKey(key secret.Secret, data secret.Secret) (string, error) {
+	encryptedData, err := s.cryptoSvc.EncryptWithKey(key, data)
+	if err != nil {
+		s.logger.Errorf("failed to encrypt data: %s", err)
+		return "", err
+	}
+
+	sealedData, err := s.pepperSvc.Seal(encryptedData)
+	if err != nil {
+		s.logger.Errorf("failed to seal encrypted data: %s", err)
+		return "", err
+	}
+
+	return sealedData, nil
+}
+
+// wrapKey wraps the vault key with pin and seals it with the pepper layer.
+func (s *service) wrapKey(pin secret.Secret, key secret.Secret) (string, error) {
+	wrappedKey, err := s.cryptoSvc.WrapKey(pin, key)
+	if err != nil {
+		s.logger.Errorf("failed to wrap vault key: %s", err)
+		return "", err
+	}
+
+	sealedKey, err := s.pepperSvc.Seal(wrappedKey)
+	if err != nil {
+		s.logger.Errorf("failed to seal vault key: %s", err)
+		return "", err
+	}
+
+	return sealedKey, nil
+}
+
+func (s *service) wrapRecoveryKey(code secret.Secret, key secret.Secret) (string, error) {
+	wrappedKey, err := s.cryptoSvc.WrapKeyWithCode(code, key)
+	if err != nil {
+		s.logger.Errorf("failed to wrap recovery key: %s", err)
+		return "", err
+	}
+
+	sealedKey, err := s.pepperSvc.Seal(wrappedKey)
+	if err != nil {
+		s.logger.Errorf("failed to seal recovery key: %s", err)
+		return "", err
+	}
+
+	return sealedKey, nil
+}
+
+// newRecoveryCode returns recoveryCodeLength random characters of
+// recoveryCodeAlphabet, 80 bits.
+func newRecoveryCode() (secret.Secret, error) {
+	b := make([]byte, recoveryCodeLength)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return secret.Secret{}, err
+	}
+
+	// The alphabet has 32 characters, so the low 5 bits pick one without
+	// bias.
+	for i := range b {
+		b[i] = recoveryCodeAlphabet[b[i]&31]
+	}
+
+	return secret.FromBytes(b), nil
+}
+
+// normalizeRecoveryCode accepts a code the way people type it: in any
+// case, with the dashes or spaces, and with the letters that are left out
+// of the alphabet because they look like digits.
+func normalizeRecoveryCode(code secret.Secret) secret.Secret {
+	normalized := make([]byte, 0, code.Len())
+	for _, c := range bytes.ToUpper(code.Bytes()) {
+		switch c {
+		case '-', ' ', '\t', '\n':
+			continue
+		case 'O':
+			c = '0'
+		case 'I', 'L':
+			c = '1'
+		}
+
+		normalized = append(normalized, c)
+	}
+
+	return secret.FromBytes(normalized)
+}
+
+func wipeAll(secrets []secret.Secret) {
+	for i := range secrets {
+		secrets[i].Wipe()
+	}
 }
@@ -0,0 +1,254 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"password-guard-bot/pkg/crypto"
+	"password-guard-bot/pkg/crypto/shamir"
+	"password-guard-bot/pkg/secret"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrInvalidShare is returned for text that isn't a share of the
+	// user's current split, or repeats a share already given.
+	ErrInvalidShare = errors.New("invalid recovery share")
+	// ErrWrongShares is returned when enough shares were given but they
+	// don't open the vault.
+	ErrWrongShares = errors.New("recovery shares don't open the vault")
+)
+
+// A share is written as "pgs1-<split id>-<base32 share>", the id tells
+// shares of an older split apart before they are combined.
+const sharePrefix = "pgs1-"
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (s *service) GetShareThreshold(chatId int64) (int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return 0, err
+	}
+
+	if user.Vault == nil || user.Vault.Shares == nil {
+		return 0, nil
+	}
+
+	return user.Vault.Shares.Threshold, nil
+}
+
+// SplitVaultKey splits a new share key into count shares, any threshold of
+// which restore access. The share key wraps the vault key, so the shares
+// of a previous split stop working.
+func (s *service) SplitVaultKey(chatId int64, pin secret.Secret, count, threshold int) (*ShareSet, []secret.Secret, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	normalizePin := pin.TrimSpace()
+	defer normalizePin.Wipe()
+
+	key, err := s.unwrapVaultKey(user, normalizePin)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer key.Wipe()
+
+	shareKey, err := s.cryptoSvc.GenerateKey()
+	if err != nil {
+		s.logger.Errorf("failed to generate share key: %s", err)
+		return nil, nil, err
+	}
+	defer shareKey.Wipe()
+
+	wrappedKey, err := s.encryptWithKey(shareKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts, err := shamir.Split(shareKey.Bytes(), count, threshold)
+	if err != nil {
+		s.logger.Errorf("failed to split share key: %s", err)
+		return nil, nil, err
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+
+	shares := make([]secret.Secret, len(parts))
+	for i, part := range parts {
+		shares[i] = encodeShare(hex.EncodeToString(id), part)
+		secret.Wipe(part)
+	}
+
+	shareSet := &ShareSet{
+		ID:         hex.EncodeToString(id),
+		Threshold:  threshold,
+		Count:      count,
+		WrappedKey: wrappedKey,
+		CreatedAt:  time.Now(),
+	}
+	user.SetShares(shareSet)
+
+	if err := s.repository.SwapVault(context.Background(), user, user.Vault.WrappedKey); err != nil {
+		wipeAll(shares)
+		return nil, nil, err
+	}
+
+	return shareSet, shares, nil
+}
+
+// CheckShares returns how many more shares are needed. Once there are
+// enough, it checks that they open the vault.
+func (s *service) CheckShares(chatId int64, shares []secret.Secret) (int, error) {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return 0, err
+	}
+
+	if user.Vault == nil || user.Vault.Shares == nil {
+		return 0, ErrInvalidShare
+	}
+
+	if len(shares) < user.Vault.Shares.Threshold {
+		parts, err := parseShares(user.Vault.Shares, shares)
+		wipeParts(parts)
+
+		return user.Vault.Shares.Threshold - len(shares), err
+	}
+
+	key, err := s.unwrapShareKey(user, shares)
+	key.Wipe()
+
+	return 0, err
+}
+
+// RecoverVaultWithShares wraps the vault key with newPin using the shares
+// instead of the old pin. The shares stay valid.
+func (s *service) RecoverVaultWithShares(chatId int64, shares []secret.Secret, newPin secret.Secret) error {
+	user, err := s.repository.GetUser(context.Background(), bson.M{"telegram_id": chatId})
+	if err != nil {
+		return err
+	}
+
+	if user.Vault == nil || user.Vault.Shares == nil {
+		return ErrInvalidShare
+	}
+
+	key, err := s.unwrapShareKey(user, shares)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+
+	normalizeNewPin := newPin.TrimSpace()
+	defer normalizeNewPin.Wipe()
+
+	wrappedKey, err := s.wrapKey(normalizeNewPin, key)
+	if err != nil {
+		return err
+	}
+
+	previousWrappedKey := user.Vault.WrappedKey
+	user.SetWrappedKey(wrappedKey)
+
+	return s.repository.SwapVault(context.Background(), user, previousWrappedKey)
+}
+
+// unwrapShareKey combines the shares and opens the vault key with the
+// result.
+func (s *service) unwrapShareKey(user *User, shares []secret.Secret) (secret.Secret, error) {
+	parts, err := parseShares(user.Vault.Shares, shares)
+	defer wipeParts(parts)
+	if err != nil {
+		return secret.Secret{}, err
+	}
+
+	combined, err := shamir.Combine(parts)
+	if err != nil {
+		return secret.Secret{}, ErrInvalidShare
+	}
+
+	shareKey := secret.FromBytes(combined)
+	defer shareKey.Wipe()
+
+	wrappedKey, err := s.pepperSvc.Open(user.Vault.Shares.WrappedKey)
+	if err != nil {
+		s.logger.Errorf("failed to open pepper layer: %s", err)
+		return secret.Secret{}, err
+	}
+
+	key, err := s.cryptoSvc.DecryptWithKey(shareKey, wrappedKey)
+	if err != nil {
+		if errors.Is(err, crypto.ErrWrongPin) {
+			return secret.Secret{}, ErrWrongShares
+		}
+
+		s.logger.Errorf("failed to unwrap vault key: %s", err)
+		return secret.Secret{}, err
+	}
+
+	return key, nil
+}
+
+func encodeShare(id string, part []byte) secret.Secret {
+	header := sharePrefix + id + "-"
+
+	encoded := make([]byte, len(header)+shareEncoding.EncodedLen(len(part)))
+	copy(encoded, header)
+	shareEncoding.Encode(encoded[len(header):], part)
+
+	return secret.FromBytes(encoded)
+}
+
+// parseShares decodes the shares of set. A share can be surrounded by other
+// text, like the rest of the document it was sent in.
+func parseShares(set *ShareSet, shares []secret.Secret) ([][]byte, error) {
+	prefix := []byte(sharePrefix + set.ID + "-")
+
+	parts := make([][]byte, 0, len(shares))
+	for _, share := range shares {
+		var encoded []byte
+		for _, field := range bytes.Fields(share.Bytes()) {
+			if bytes.HasPrefix(bytes.ToLower(field), prefix) {
+				encoded = bytes.ToUpper(field[len(prefix):])
+				break
+			}
+		}
+
+		part := make([]byte, shareEncoding.DecodedLen(len(encoded)))
+		n, err := shareEncoding.Decode(part, encoded)
+		secret.Wipe(encoded)
+		if err != nil || n < 2 {
+			secret.Wipe(part)
+			return parts, ErrInvalidShare
+		}
+		part = part[:n]
+
+		for _, other := range parts {
+			if len(other) != len(part) || other[len(other)-1] == part[len(part)-1] {
+				secret.Wipe(part)
+				return parts, ErrInvalidShare
+			}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+func wipeParts(parts [][]byte) {
+	for _, part := range parts {
+		secret.Wipe(part)
+	}
+}
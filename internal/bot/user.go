@@ -2,6 +2,7 @@ package bot
 
 import (
 	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -9,7 +10,36 @@ import (
 type User struct {
 	ID         primitive.ObjectID `bson:"_id"`
 	TelegramId int64              `bson:"telegram_id"`
-	Data       *map[string]string `bson:"data"`
+	Vault      *Vault             `bson:"vault,omitempty"`
+	Settings   *UserSettings      `bson:"settings,omitempty"`
+}
+
+// UserSettings are the preferences picked with /settings, the zero value
+// is the default.
+type UserSettings struct {
+	EntryOrder string `bson:"entry_order,omitempty"`
+}
+
+// Vault holds the user's data encryption key, wrapped by a key derived from
+// the pin. Entries are encrypted with the unwrapped key, so changing the
+// pin only rewraps the key.
+//
+// Every recovery key wraps the same key with a one-time recovery code.
+type Vault struct {
+	WrappedKey   string    `bson:"wrapped_key"`
+	RecoveryKeys []string  `bson:"recovery_keys,omitempty"`
+	Shares       *ShareSet `bson:"shares,omitempty"`
+	UpdatedAt    time.Time `bson:"updated_at"`
+}
+
+// ShareSet is the latest Shamir split of a vault. The shares combine into
+// a share key that wraps the vault key, so only this split's shares work.
+type ShareSet struct {
+	ID         string    `bson:"id"`
+	Threshold  int       `bson:"threshold"`
+	Count      int       `bson:"count"`
+	WrappedKey string    `bson:"wrapped_key"`
+	CreatedAt  time.Time `bson:"created_at"`
 }
 
 func NewUser(telegramId *int64) (*User, error) {
@@ -20,18 +50,30 @@ func NewUser(telegramId *int64) (*User, error) {
 	return &User{
 		ID:         primitive.NewObjectID(),
 		TelegramId: *telegramId,
-		Data:       nil,
 	}, nil
 }
 
-func (u *User) AddData(fromWhatData string, encryptedData string) {
-	if u.Data == nil {
-		u.Data = &map[string]string{fromWhatData: encryptedData}
-	} else {
-		(*u.Data)[fromWhatData] = encryptedData
+// SetWrappedKey keeps the recovery keys, they wrap the same vault key.
+func (u *User) SetWrappedKey(wrappedKey string) {
+	if u.Vault == nil {
+		u.Vault = &Vault{}
 	}
+
+	u.Vault.WrappedKey = wrappedKey
+	u.Vault.UpdatedAt = time.Now()
+}
+
+func (u *User) SetRecoveryKeys(recoveryKeys []string) {
+	u.Vault.RecoveryKeys = recoveryKeys
+	u.Vault.UpdatedAt = time.Now()
+}
+
+func (u *User) SetShares(shares *ShareSet) {
+	u.Vault.Shares = shares
+	u.Vault.UpdatedAt = time.Now()
 }
 
-func (u *User) DeleteData(what string) {
-	delete(*u.Data, what)
+func (u *User) RemoveRecoveryKey(i int) {
+	u.Vault.RecoveryKeys = append(u.Vault.RecoveryKeys[:i], u.Vault.RecoveryKeys[i+1:]...)
+	u.Vault.UpdatedAt = time.Now()
 }
@@ -1,12 +1,52 @@
 package bot
 
+import (
+	"password-guard-bot/pkg/generator"
+	"password-guard-bot/pkg/secret"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 type UserState struct {
-	State    string
-	Page     int
-	From     string
-	Pin      string
-	Login    string
-	Password string
+	State       string
+	Page        int
+	From        string
+	EntryId     primitive.ObjectID
+	Type        string
+	Version     int
+	Pin         secret.Secret
+	PinAttempts int
+	NewPin      secret.Secret
+	Recovery    secret.Secret
+	Shares      []secret.Secret
+	Login       secret.Secret
+	Password    secret.Secret
+	URL         secret.Secret
+	Notes       secret.Secret
+	Content     secret.Secret
+	Folder      string
+	Tags        []string
+	GenOptions  generator.Options
+	Generated   secret.Secret
+
+	// Fields are the custom fields entered so far, Field is the one being
+	// entered.
+	Fields []CustomField
+	Field  CustomField
+
+	// Reveal is the hidden field or attachment picked to be revealed.
+	Reveal string
+
+	// Groups are the folders and tags offered by the entry picker, Group
+	// is the one picked.
+	Groups []EntryGroup
+	Group  *EntryGroup
+
+	ShareThreshold int
+	ShareCount     int
+
+	// Next is the state to go on with after the recovery codes offer.
+	Next string
 }
 
 func (u *UserState) UpdateState(state string) {
@@ -25,23 +65,188 @@ func (u *UserState) UpdateFrom(from string) {
 	u.From = from
 }
 
+// UpdateEntryId takes the id from callback data, anything else leaves no
+// entry selected.
+func (u *UserState) UpdateEntryId(hex string) {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		id = primitive.NilObjectID
+	}
+
+	u.EntryId = id
+}
+
+func (u *UserState) UpdateVersion(version int) {
+	u.Version = version
+}
+
 func (u *UserState) UpdatePin(pin string) {
-	u.Pin = pin
+	u.Pin.Wipe()
+	u.Pin = secret.New(pin)
+}
+
+func (u *UserState) IncPinAttempts() {
+	u.PinAttempts += 1
+}
+
+func (u *UserState) UpdateNewPin(pin string) {
+	u.NewPin.Wipe()
+	u.NewPin = secret.New(pin)
+}
+
+func (u *UserState) UpdateRecovery(code string) {
+	u.Recovery.Wipe()
+	for i := range u.Shares {
+		u.Shares[i].Wipe()
+	}
+	u.Shares = nil
+	u.Recovery = secret.New(code)
+}
+
+func (u *UserState) AddShare(share string) {
+	u.Shares = append(u.Shares, secret.New(share))
+}
+
+func (u *UserState) DropLastShare() {
+	u.Shares[len(u.Shares)-1].Wipe()
+	u.Shares = u.Shares[:len(u.Shares)-1]
+}
+
+func (u *UserState) UpdateShareSize(threshold, count int) {
+	u.ShareThreshold = threshold
+	u.ShareCount = count
+}
+
+func (u *UserState) UpdateNext(next string) {
+	u.Next = next
 }
 
 func (u *UserState) UpdateLogin(login string) {
-	u.Login = login
+	u.Login.Wipe()
+	u.Login = secret.New(login)
 }
 
 func (u *UserState) UpdatePassword(password string) {
-	u.Password = password
+	u.Password.Wipe()
+	u.Password = secret.New(password)
+}
+
+func (u *UserState) UpdateURL(url string) {
+	u.URL.Wipe()
+	u.URL = secret.New(url)
+}
+
+func (u *UserState) UpdateNotes(notes string) {
+	u.Notes.Wipe()
+	u.Notes = secret.New(notes)
+}
+
+func (u *UserState) UpdateType(entryType string) {
+	u.Type = entryType
+}
+
+// UpdateContent keeps content as it is, white space included.
+func (u *UserState) UpdateContent(content string) {
+	u.Content.Wipe()
+	u.Content = secret.New(content)
+}
+
+func (u *UserState) UpdateFieldName(name string) {
+	u.Field.Value.Wipe()
+	u.Field = CustomField{Name: name}
+}
+
+func (u *UserState) UpdateFieldValue(value string) {
+	u.Field.Value.Wipe()
+	u.Field.Value = secret.New(value)
+}
+
+// AddField adds the field being entered to the custom fields.
+func (u *UserState) AddField(hidden bool) {
+	u.Field.Hidden = hidden
+	u.Fields = append(u.Fields, u.Field)
+	u.Field = CustomField{}
+}
+
+// UpdateFields takes ownership of fields, they are wiped with the state.
+func (u *UserState) UpdateFields(fields []CustomField) {
+	u.ClearFields()
+	u.Fields = fields
+}
+
+func (u *UserState) ClearFields() {
+	for i := range u.Fields {
+		u.Fields[i].Value.Wipe()
+	}
+	u.Fields = nil
+	u.Field.Value.Wipe()
+	u.Field = CustomField{}
+}
+
+func (u *UserState) UpdateReveal(reveal string) {
+	u.Reveal = reveal
+}
+
+func (u *UserState) UpdateFolder(folder string, tags []string) {
+	u.Folder = folder
+	u.Tags = tags
+}
+
+func (u *UserState) UpdateGroups(groups []EntryGroup) {
+	u.Groups = groups
+}
+
+// UpdateGroup goes to the entries of group, or back to the groups if it is
+// nil.
+func (u *UserState) UpdateGroup(group *EntryGroup) {
+	u.Group = group
+	u.Page = 1
+}
+
+func (u *UserState) UpdateGenOptions(options generator.Options) {
+	u.GenOptions = options
+}
+
+func (u *UserState) UpdateGenerated(generated string) {
+	u.Generated.Wipe()
+	u.Generated = secret.New(generated)
+}
+
+// UseGenerated takes the generated password as the password.
+func (u *UserState) UseGenerated() {
+	u.Password.Wipe()
+	u.Password = u.Generated.Clone()
 }
 
 func (u *UserState) Refresh() {
 	u.State = ""
 	u.Page = 1
 	u.From = ""
-	u.Pin = ""
-	u.Login = ""
-	u.Password = ""
+	u.EntryId = primitive.NilObjectID
+	u.Type = ""
+	u.Version = 0
+	u.Pin.Wipe()
+	u.PinAttempts = 0
+	u.NewPin.Wipe()
+	u.Recovery.Wipe()
+	for i := range u.Shares {
+		u.Shares[i].Wipe()
+	}
+	u.Shares = nil
+	u.Login.Wipe()
+	u.Password.Wipe()
+	u.URL.Wipe()
+	u.Notes.Wipe()
+	u.Content.Wipe()
+	u.Folder = ""
+	u.Tags = nil
+	u.Groups = nil
+	u.Group = nil
+	u.GenOptions = generator.Options{}
+	u.Generated.Wipe()
+	u.ClearFields()
+	u.Reveal = ""
+	u.ShareThreshold = 0
+	u.ShareCount = 0
+	u.Next = ""
 }
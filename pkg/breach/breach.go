@@ -0,0 +1,156 @@
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Checker tells how often a password appears in a breach corpus.
+type Checker interface {
+	Count(password []byte) (int, error)
+}
+
+// checker searches a Pwned Passwords file: one "SHA1:COUNT" line per hash,
+// upper case hex, sorted by hash. The file is never read into memory, every
+// lookup is a binary search over the file offsets.
+type checker struct {
+	file *os.File
+	size int64
+}
+
+func NewChecker(path string) (Checker, error) {
+	if path == "" {
+		return nil, errors.New("invalid breach file path")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	c := &checker{file: file, size: info.Size()}
+
+	// Catch a file in some other format right away instead of silently
+	// finding nothing.
+	if c.size > 0 {
+		line, err := c.lineAt(0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if _, _, err := parseLine(line); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *checker) Count(password []byte) (int, error) {
+	sum := sha1.Sum(password)
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// Find the first line with a hash not below ours.
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		line, err := c.lineAt(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		lineHash, _, err := parseLine(line)
+		if err != nil && line != "" {
+			return 0, err
+		}
+
+		if line == "" || lineHash >= hash {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	line, err := c.lineAt(lo)
+	if err != nil || line == "" {
+		return 0, err
+	}
+
+	lineHash, count, err := parseLine(line)
+	if err != nil {
+		return 0, err
+	}
+
+	if lineHash != hash {
+		return 0, nil
+	}
+
+	return count, nil
+}
+
+// lineAt returns the first line that starts at offset or after it, or an
+// empty line at the end of the file.
+func (c *checker) lineAt(offset int64) (string, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(c.file, start, c.size-start))
+
+	if offset > 0 {
+		if _, err := reader.ReadString('\n'); err == io.EOF {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func parseLine(line string) (string, int, error) {
+	hash, count, ok := strings.Cut(line, ":")
+	if !ok || len(hash) != sha1.Size*2 {
+		return "", 0, fmt.Errorf("invalid breach file line %q", line)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid breach file line %q", line)
+	}
+
+	return strings.ToUpper(hash), n, nil
+}
+
+// nopChecker is used when no breach file is configured.
+type nopChecker struct{}
+
+func NewNopChecker() Checker {
+	return &nopChecker{}
+}
+
+func (c *nopChecker) Count(password []byte) (int, error) {
+	return 0, nil
+}
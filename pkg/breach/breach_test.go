@@ -0,0 +1,90 @@
+package breach_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"password-guard-bot/pkg/breach"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeBreachFile(t *testing.T, passwords map[string]int) string {
+	t.Helper()
+
+	var lines []string
+	for password, count := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":"+strconv.Itoa(count))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCount(t *testing.T) {
+	passwords := map[string]int{
+		"password":  9545824,
+		"123456":    37359195,
+		"qwerty":    3946737,
+		"iloveyou":  1645337,
+		"letmein":   511633,
+		"monkey":    1014247,
+		"dragon":    985429,
+		"sunshine":  426740,
+		"trustno1":  107924,
+		"p@ssw0rd!": 5,
+	}
+
+	checker, err := breach.NewChecker(writeBreachFile(t, passwords))
+	if err != nil {
+		t.Fatalf("NewChecker() error = %s", err)
+	}
+
+	for password, want := range passwords {
+		t.Run(password, func(t *testing.T) {
+			got, err := checker.Count([]byte(password))
+			if err != nil {
+				t.Fatalf("Count() error = %s", err)
+			}
+
+			if got != want {
+				t.Errorf("Count() got = %d, want %d", got, want)
+			}
+		})
+	}
+
+	for _, password := range []string{"", "correct-horse-battery-staple", "Password", "zzzzzzzz"} {
+		got, err := checker.Count([]byte(password))
+		if err != nil {
+			t.Fatalf("Count() error = %s", err)
+		}
+
+		if got != 0 {
+			t.Errorf("Count(%q) got = %d, want 0", password, got)
+		}
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-pwned-passwords.txt")
+	if err := os.WriteFile(path, []byte("password,9545824\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := breach.NewChecker(path); err == nil {
+		t.Errorf("NewChecker() accepted a file in the wrong format")
+	}
+
+	if _, err := breach.NewChecker(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("NewChecker() accepted a missing file")
+	}
+}
@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bounds used when the config leaves the calibration floor or ceiling
+// unset. The PBKDF2 floor follows the OWASP recommendation for SHA-512.
+const (
+	defaultPBKDF2Floor   = 210000
+	defaultPBKDF2Ceiling = 10000000
+	defaultArgonFloor    = 1
+	defaultArgonCeiling  = 20
+
+	// Calibrated PBKDF2 counts are rounded down to this step, so restarts
+	// on the same host end up with the same params.
+	pbkdf2Step = 10000
+
+	pbkdf2Probe      = 20000
+	calibrationRuns  = 3
+	calibrationInput = "calibration"
+)
+
+// calibrate returns p with the cost chosen so that one derivation takes
+// about target on this host, clamped to [floor, ceiling]. For PBKDF2 the
+// cost is the iteration count, for Argon2id the time cost; the Argon2id
+// memory and threads stay as configured. Zero bounds use the defaults.
+func calibrate(p KdfParams, target time.Duration, floor, ceiling int) (KdfParams, error) {
+	probe := KdfParams{Algorithm: p.Algorithm, Memory: p.Memory, Threads: p.Threads, KeyLength: p.KeyLength, Salt: make([]byte, saltSize)}
+	step := 1
+
+	switch p.Algorithm {
+	case KdfPBKDF2SHA512:
+		floor, ceiling = withDefault(floor, defaultPBKDF2Floor), withDefault(ceiling, defaultPBKDF2Ceiling)
+		probe.Iterations = pbkdf2Probe
+		step = pbkdf2Step
+	case KdfArgon2id:
+		floor, ceiling = withDefault(floor, defaultArgonFloor), withDefault(ceiling, defaultArgonCeiling)
+		probe.Iterations = 1
+	default:
+		return KdfParams{}, fmt.Errorf("key derivation algorithm %d can't be calibrated", p.Algorithm)
+	}
+
+	if floor > ceiling {
+		return KdfParams{}, fmt.Errorf("calibration floor %d is above the ceiling %d", floor, ceiling)
+	}
+
+	elapsed, err := measure(probe)
+	if err != nil {
+		return KdfParams{}, err
+	}
+
+	// Both costs scale linearly with the time taken.
+	cost := int(float64(probe.Iterations) * float64(target) / float64(max(elapsed, time.Nanosecond)))
+	cost = cost / step * step
+
+	p.Iterations = uint32(min(max(cost, floor), ceiling))
+
+	return p, nil
+}
+
+// measure returns the fastest of a few derivations, the slower ones are
+// mostly noise from whatever else runs at startup.
+func measure(p KdfParams) (time.Duration, error) {
+	fastest := time.Duration(0)
+
+	for i := 0; i < calibrationRuns; i++ {
+		start := time.Now()
+		if _, err := p.deriveKey([]byte(calibrationInput)); err != nil {
+			return 0, err
+		}
+
+		if elapsed := time.Since(start); i == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+
+	return fastest, nil
+}
+
+func withDefault(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+
+	return value
+}
+
+// String describes the algorithm and cost, for logs.
+func (p KdfParams) String() string {
+	switch p.Algorithm {
+	case KdfNone:
+		return "none"
+	case KdfPBKDF2SHA512:
+		return fmt.Sprintf("pbkdf2-sha512, %d iterations", p.Iterations)
+	case KdfArgon2id:
+		return fmt.Sprintf("argon2id, time %d, memory %d KiB, %d threads", p.Iterations, p.Memory, p.Threads)
+	case KdfHKDFSHA256:
+		return "hkdf-sha256"
+	}
+
+	return fmt.Sprintf("unknown algorithm %d", p.Algorithm)
+}
@@ -8,65 +8,272 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"password-guard-bot/config"
+	"password-guard-bot/pkg/secret"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// ErrWrongPin is returned by Decrypt when the pin does not open the data.
+var ErrWrongPin = errors.New("wrong pin")
+
+// CryptoService takes and returns pins, keys and plaintext as secrets, the
+// caller wipes them. Keys derived on the way are wiped before returning.
 type CryptoService interface {
-	Encrypt(pin []byte, data []byte) (string, error)
-	Decrypt(pin []byte, data string) (string, error)
-	GenerateNormalSizeCode(currentCode string) []byte
+	Encrypt(pin secret.Secret, data secret.Secret) (string, error)
+	Decrypt(pin secret.Secret, data string) (secret.Secret, error)
+	NeedsUpgrade(data string) bool
+	NeedsPin(data string) bool
+	Kdf() KdfParams
+
+	GenerateKey() (secret.Secret, error)
+	WrapKey(pin secret.Secret, key secret.Secret) (string, error)
+	WrapKeyWithCode(code secret.Secret, key secret.Secret) (string, error)
+	UnwrapKey(pin secret.Secret, wrappedKey string) (secret.Secret, error)
+	EncryptWithKey(key secret.Secret, data secret.Secret) (string, error)
+	DecryptWithKey(key secret.Secret, data string) (secret.Secret, error)
+	EncryptStream(key secret.Secret, dst io.Writer, src io.Reader) error
+	DecryptStream(key secret.Secret, dst io.Writer, src io.Reader) error
 }
 
 type crypto struct {
-	iteration int
+	kdf             KdfParams
+	legacyIteration int
 }
 
-func NewCryptoService(iteration *int) (CryptoService, error) {
-	if iteration == nil {
-		return nil, errors.New("incorrect iteration")
+func NewCryptoService(cfg *config.Crypto) (CryptoService, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid crypto config")
+	}
+
+	kdf, err := newKdfParams(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.KdfTarget > 0 {
+		kdf, err = calibrate(kdf, cfg.KdfTarget, cfg.KdfMinCost, cfg.KdfMaxCost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := kdf.validate(); err != nil {
+		return nil, err
+	}
+
+	// Records written before the KDF params were stored used the global
+	// iteration count, keep it around for them.
+	legacyIteration := cfg.LegacyIteration
+	if legacyIteration == 0 {
+		legacyIteration = cfg.Iteration
 	}
 
-	return &crypto{iteration: *iteration}, nil
+	return &crypto{kdf: kdf, legacyIteration: legacyIteration}, nil
 }
 
-func (c *crypto) Encrypt(pin []byte, data []byte) (string, error) {
-	block, err := aes.NewCipher(pin)
+func (c *crypto) Encrypt(pin secret.Secret, data secret.Secret) (string, error) {
+	kdf, err := c.kdf.withSalt()
 	if err != nil {
 		return "", err
 	}
 
-	// The IV needs to be unique, but not secure. Therefore it's common to
-	// include it at the beginning of the ciphertext.
-	ciphertext := make([]byte, aes.BlockSize+len(data))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	key, err := kdf.deriveKey(pin.Bytes())
+	if err != nil {
 		return "", err
 	}
+	defer secret.Wipe(key)
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], data)
+	return encrypt(kdf, key, data.Bytes())
+}
 
-	// convert to base64
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+func (c *crypto) Decrypt(pin secret.Secret, data string) (secret.Secret, error) {
+	plaintext, err := c.decrypt(data, func(e *envelope) ([]byte, error) {
+		if e.kdf == nil {
+			return c.legacyKey(pin.Bytes()), nil
+		}
+
+		return e.kdf.deriveKey(pin.Bytes())
+	})
+	if err != nil {
+		return secret.Secret{}, err
+	}
+
+	return secret.FromBytes(plaintext), nil
+}
+
+// NeedsUpgrade reports whether data was produced by an older format or
+// with a weaker key derivation than configured, and should be encrypted
+// again once it has been decrypted.
+func (c *crypto) NeedsUpgrade(data string) bool {
+	e, ok := parse(data)
+	if !ok || e.kdf == nil || e.algorithm != AlgAES256GCM {
+		return true
+	}
+
+	return e.kdf.Algorithm != KdfNone && e.kdf.weakerThan(c.kdf)
+}
+
+// NeedsPin reports whether data is sealed with a key derived from a pin,
+// rather than with a key passed to EncryptWithKey.
+func (c *crypto) NeedsPin(data string) bool {
+	e, ok := parse(data)
+
+	return !ok || e.kdf == nil || e.kdf.Algorithm != KdfNone
+}
+
+// Kdf returns the key derivation params used for new entries, after
+// calibration if it is enabled.
+func (c *crypto) Kdf() KdfParams {
+	return c.kdf
+}
+
+// GenerateKey returns a new random key for EncryptWithKey.
+func (c *crypto) GenerateKey() (secret.Secret, error) {
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return secret.Secret{}, err
+	}
+
+	return secret.FromBytes(key), nil
+}
+
+// WrapKey encrypts a key from GenerateKey with a pin.
+func (c *crypto) WrapKey(pin secret.Secret, key secret.Secret) (string, error) {
+	return c.Encrypt(pin, key)
 }
 
-func (c *crypto) Decrypt(pin []byte, data string) (string, error) {
-	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+// WrapKeyWithCode encrypts a key from GenerateKey with a random code. The
+// code is not stretched, it has to be long enough to resist guessing on
+// its own.
+func (c *crypto) WrapKeyWithCode(code secret.Secret, key secret.Secret) (string, error) {
+	kdf, err := KdfParams{Algorithm: KdfHKDFSHA256, KeyLength: keyLength}.withSalt()
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(pin)
+	derived, err := kdf.deriveKey(code.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer secret.Wipe(derived)
+
+	return encrypt(kdf, derived, key.Bytes())
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey or WrapKeyWithCode.
+func (c *crypto) UnwrapKey(pin secret.Secret, wrappedKey string) (secret.Secret, error) {
+	key, err := c.decrypt(wrappedKey, func(e *envelope) ([]byte, error) {
+		if e.kdf == nil || e.kdf.Algorithm == KdfNone {
+			return nil, errors.New("wrapped key has no key derivation params")
+		}
+
+		return e.kdf.deriveKey(pin.Bytes())
+	})
+	if err != nil {
+		return secret.Secret{}, err
+	}
+
+	return secret.FromBytes(key), nil
+}
+
+func (c *crypto) EncryptWithKey(key secret.Secret, data secret.Secret) (string, error) {
+	return encrypt(KdfParams{Algorithm: KdfNone}, key.Bytes(), data.Bytes())
+}
+
+func (c *crypto) DecryptWithKey(key secret.Secret, data string) (secret.Secret, error) {
+	plaintext, err := c.decrypt(data, func(e *envelope) ([]byte, error) {
+		if e.kdf == nil || e.kdf.Algorithm != KdfNone {
+			return nil, errors.New("data is encrypted with a pin")
+		}
+
+		// decrypt wipes the key it gets, the caller still needs theirs.
+		return append([]byte(nil), key.Bytes()...), nil
+	})
+	if err != nil {
+		return secret.Secret{}, err
+	}
+
+	return secret.FromBytes(plaintext), nil
+}
+
+// decrypt opens data with the key returned by keyFor and wipes the key
+// afterwards. Legacy records are passed to keyFor as an empty envelope.
+func (c *crypto) decrypt(data string, keyFor func(e *envelope) ([]byte, error)) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok, err := parseEnvelope(blob)
 	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		key, err := keyFor(&envelope{})
+		if err != nil {
+			return nil, err
+		}
+		defer secret.Wipe(key)
+
+		return decryptLegacy(key, blob)
+	}
+
+	key, err := keyFor(e)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Wipe(key)
+
+	return open(e, key)
+}
+
+// legacyKey derives the salt-less key used before the KDF params were
+// stored with every entry.
+func (c *crypto) legacyKey(pin []byte) []byte {
+	return pbkdf2.Key(pin, []byte{}, c.legacyIteration, keyLength, sha512.New)
+}
+
+func encrypt(kdf KdfParams, key []byte, data []byte) (string, error) {
+	e := newEnvelope(AlgAES256GCM, kdf)
+	if err := seal(e, key, data); err != nil {
 		return "", err
 	}
 
+	// convert to base64
+	return base64.StdEncoding.EncodeToString(e.bytes()), nil
+}
+
+func parse(data string) (*envelope, bool) {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, false
+	}
+
+	e, ok, err := parseEnvelope(blob)
+	if err != nil {
+		return nil, false
+	}
+
+	return e, ok
+}
+
+// decryptLegacy opens records written before the envelope format existed:
+// a bare AES-CFB ciphertext prefixed with its IV. CFB has no integrity
+// check, so a wrong pin can only be guessed from the output.
+func decryptLegacy(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
 	// The IV needs to be unique, but not secure. Therefore it's common to
 	// include it at the beginning of the ciphertext.
 	if len(ciphertext) < aes.BlockSize {
-		return "", errors.New("ciphertext too short")
+		return nil, errors.New("ciphertext too short")
 	}
 	iv := ciphertext[:aes.BlockSize]
 	ciphertext = ciphertext[aes.BlockSize:]
@@ -76,11 +283,11 @@ func (c *crypto) Decrypt(pin []byte, data string) (string, error) {
 	// XORKeyStream can work in-place if the two arguments are the same.
 	stream.XORKeyStream(ciphertext, ciphertext)
 
-	return string(ciphertext), nil
-}
-
-func (c *crypto) GenerateNormalSizeCode(currentCode string) []byte {
-	dk := pbkdf2.Key([]byte(currentCode), []byte{}, c.iteration, 32, sha512.New)
+	// Everything we ever stored was text, so invalid UTF-8 means the pin
+	// was wrong. It is only a heuristic, short garbage can still pass.
+	if !utf8.Valid(ciphertext) {
+		return nil, ErrWrongPin
+	}
 
-	return dk
+	return ciphertext, nil
 }
@@ -0,0 +1,529 @@
+package crypto_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"password-guard-bot/config"
+	"password-guard-bot/pkg/crypto"
+	"password-guard-bot/pkg/secret"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func newService(t *testing.T, cfg config.Crypto) crypto.CryptoService {
+	t.Helper()
+
+	svc, err := crypto.NewCryptoService(&cfg)
+	if err != nil {
+		t.Fatalf("NewCryptoService() error = %s", err)
+	}
+
+	return svc
+}
+
+// encryptLegacy reproduces the salt-less AES-CFB format used before the
+// envelope.
+func encryptLegacy(t *testing.T, pin string, iteration int, data []byte) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(pin), []byte{}, iteration, 32, sha512.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, aes.BlockSize+len(data))
+	cipher.NewCFBEncrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(ciphertext[aes.BlockSize:], data)
+
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	tests := []struct {
+		name      string
+		pin       string
+		tamper    func(blob []byte)
+		want      string
+		wantError bool
+	}{
+		{
+			name: "Correct pin",
+			pin:  "1234",
+			want: "login:password",
+		},
+		{
+			name:      "Wrong pin",
+			pin:       "4321",
+			wantError: true,
+		},
+		{
+			name:      "Tampered ciphertext",
+			pin:       "1234",
+			tamper:    func(blob []byte) { blob[len(blob)-1] ^= 1 },
+			wantError: true,
+		},
+		{
+			name:      "Tampered algorithm id",
+			pin:       "1234",
+			tamper:    func(blob []byte) { blob[3] = crypto.AlgXChaCha20Poly1305 },
+			wantError: true,
+		},
+		{
+			name:      "Tampered salt",
+			pin:       "1234",
+			tamper:    func(blob []byte) { blob[12] ^= 1 },
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypted, err := svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+			if err != nil {
+				t.Fatalf("Encrypt() error = %s", err)
+			}
+
+			if svc.NeedsUpgrade(encrypted) {
+				t.Errorf("NeedsUpgrade() = true for a fresh envelope")
+			}
+
+			if test.tamper != nil {
+				blob, _ := base64.StdEncoding.DecodeString(encrypted)
+				test.tamper(blob)
+				encrypted = base64.StdEncoding.EncodeToString(blob)
+			}
+
+			got, err := svc.Decrypt(secret.New(test.pin), encrypted)
+			if (err != nil) != test.wantError {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, test.wantError)
+			}
+
+			if test.wantError && !errors.Is(err, crypto.ErrWrongPin) {
+				t.Errorf("Decrypt() error = %v, want %v", err, crypto.ErrWrongPin)
+			}
+
+			if string(got.Bytes()) != test.want {
+				t.Errorf("Decrypt() got = %q, want %q", got.Bytes(), test.want)
+			}
+		})
+	}
+}
+
+func TestEncryptUsesRandomSalt(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	first, _ := svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+	second, _ := svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+
+	firstBlob, _ := base64.StdEncoding.DecodeString(first)
+	secondBlob, _ := base64.StdEncoding.DecodeString(second)
+
+	// magic, version, algorithm, kdf id, iterations, key length, salt length
+	const saltOffset = 2 + 1 + 1 + 1 + 4 + 1 + 1
+	if string(firstBlob[saltOffset:saltOffset+16]) == string(secondBlob[saltOffset:saltOffset+16]) {
+		t.Errorf("Encrypt() reused the salt")
+	}
+}
+
+func TestDecryptAfterIterationChange(t *testing.T) {
+	old := newService(t, config.Crypto{Iteration: 15})
+
+	encrypted, err := old.Encrypt(secret.New("1234"), secret.New("login:password"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %s", err)
+	}
+
+	svc := newService(t, config.Crypto{Iteration: 30, LegacyIteration: 15})
+
+	got, err := svc.Decrypt(secret.New("1234"), encrypted)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %s", err)
+	}
+
+	if string(got.Bytes()) != "login:password" {
+		t.Errorf("Decrypt() got = %q, want %q", got.Bytes(), "login:password")
+	}
+
+	if !svc.NeedsUpgrade(encrypted) {
+		t.Errorf("NeedsUpgrade() = false for an entry with a lower iteration count")
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 30, LegacyIteration: 15})
+
+	legacy := encryptLegacy(t, "1234", 15, []byte("login:password"))
+	if !svc.NeedsUpgrade(legacy) {
+		t.Errorf("NeedsUpgrade() = false for a legacy record")
+	}
+
+	got, err := svc.Decrypt(secret.New("1234"), legacy)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %s", err)
+	}
+
+	if string(got.Bytes()) != "login:password" {
+		t.Errorf("Decrypt() got = %q, want %q", got.Bytes(), "login:password")
+	}
+}
+
+func TestDecryptUnknownVersion(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	encrypted, err := svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %s", err)
+	}
+
+	blob, _ := base64.StdEncoding.DecodeString(encrypted)
+	blob[2] = 9
+	encrypted = base64.StdEncoding.EncodeToString(blob)
+
+	if _, err := svc.Decrypt(secret.New("1234"), encrypted); err == nil || errors.Is(err, crypto.ErrWrongPin) {
+		t.Errorf("Decrypt() error = %v, want an unknown version error", err)
+	}
+}
+
+func TestDecryptMixedKdf(t *testing.T) {
+	pbkdf2Svc := newService(t, config.Crypto{Kdf: "pbkdf2", Iteration: 15})
+	argonSvc := newService(t, config.Crypto{Kdf: "argon2id", Iteration: 15, ArgonTime: 1, ArgonMemory: 64, ArgonThreads: 1})
+
+	pbkdf2Entry, err := pbkdf2Svc.Encrypt(secret.New("1234"), secret.New("pbkdf2:entry"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %s", err)
+	}
+
+	argonEntry, err := argonSvc.Encrypt(secret.New("1234"), secret.New("argon:entry"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %s", err)
+	}
+
+	for _, svc := range []crypto.CryptoService{pbkdf2Svc, argonSvc} {
+		for entry, want := range map[string]string{pbkdf2Entry: "pbkdf2:entry", argonEntry: "argon:entry"} {
+			got, err := svc.Decrypt(secret.New("1234"), entry)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %s", err)
+			}
+
+			if string(got.Bytes()) != want {
+				t.Errorf("Decrypt() got = %q, want %q", got.Bytes(), want)
+			}
+		}
+	}
+
+	if !argonSvc.NeedsUpgrade(pbkdf2Entry) {
+		t.Errorf("NeedsUpgrade() = false for a PBKDF2 entry while Argon2id is configured")
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Crypto
+		want uint32
+	}{
+		{
+			name: "PBKDF2 floor",
+			cfg:  config.Crypto{Kdf: "pbkdf2", Iteration: 15, KdfTarget: time.Nanosecond, KdfMinCost: 1000, KdfMaxCost: 50000},
+			want: 1000,
+		},
+		{
+			name: "PBKDF2 ceiling",
+			cfg:  config.Crypto{Kdf: "pbkdf2", Iteration: 15, KdfTarget: time.Hour, KdfMinCost: 1000, KdfMaxCost: 50000},
+			want: 50000,
+		},
+		{
+			name: "Argon2id ceiling",
+			cfg:  config.Crypto{Kdf: "argon2id", Iteration: 15, ArgonTime: 1, ArgonMemory: 64, ArgonThreads: 1, KdfTarget: time.Hour, KdfMaxCost: 4},
+			want: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newService(t, test.cfg)
+
+			if got := svc.Kdf().Iterations; got != test.want {
+				t.Errorf("Kdf().Iterations got = %d, want %d", got, test.want)
+			}
+
+			encrypted, err := svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+			if err != nil {
+				t.Fatalf("Encrypt() error = %s", err)
+			}
+
+			// The calibrated cost is stored with the entry, a service with
+			// the plain config still opens it.
+			plain := test.cfg
+			plain.KdfTarget = 0
+			if _, err := newService(t, plain).Decrypt(secret.New("1234"), encrypted); err != nil {
+				t.Errorf("Decrypt() error = %s", err)
+			}
+		})
+	}
+
+	if _, err := crypto.NewCryptoService(&config.Crypto{Iteration: 15, KdfTarget: time.Second, KdfMinCost: 10, KdfMaxCost: 5}); err == nil {
+		t.Errorf("NewCryptoService() accepted a floor above the ceiling")
+	}
+}
+
+func TestDecryptRejectsStoredCost(t *testing.T) {
+	pbkdf2Svc := newService(t, config.Crypto{Kdf: "pbkdf2", Iteration: 15})
+	argonSvc := newService(t, config.Crypto{Kdf: "argon2id", Iteration: 15, ArgonTime: 1, ArgonMemory: 64, ArgonThreads: 1})
+
+	// magic, version, algorithm, then the kdf id
+	const kdfOffset = 2 + 1 + 1
+
+	tests := []struct {
+		name   string
+		svc    crypto.CryptoService
+		tamper func(blob []byte)
+	}{
+		{
+			name:   "PBKDF2 iterations too high",
+			svc:    pbkdf2Svc,
+			tamper: func(blob []byte) { binary.BigEndian.PutUint32(blob[kdfOffset+1:], math.MaxUint32) },
+		},
+		{
+			name:   "PBKDF2 iterations zero",
+			svc:    pbkdf2Svc,
+			tamper: func(blob []byte) { binary.BigEndian.PutUint32(blob[kdfOffset+1:], 0) },
+		},
+		{
+			name:   "Argon2id time zero",
+			svc:    argonSvc,
+			tamper: func(blob []byte) { binary.BigEndian.PutUint32(blob[kdfOffset+1:], 0) },
+		},
+		{
+			name:   "Argon2id memory too high",
+			svc:    argonSvc,
+			tamper: func(blob []byte) { binary.BigEndian.PutUint32(blob[kdfOffset+5:], math.MaxUint32) },
+		},
+		{
+			name:   "Argon2id threads zero",
+			svc:    argonSvc,
+			tamper: func(blob []byte) { blob[kdfOffset+9] = 0 },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypted, err := test.svc.Encrypt(secret.New("1234"), secret.New("login:password"))
+			if err != nil {
+				t.Fatalf("Encrypt() error = %s", err)
+			}
+
+			blob, _ := base64.StdEncoding.DecodeString(encrypted)
+			test.tamper(blob)
+			encrypted = base64.StdEncoding.EncodeToString(blob)
+
+			if _, err := test.svc.Decrypt(secret.New("1234"), encrypted); err == nil {
+				t.Errorf("Decrypt() accepted the stored cost")
+			}
+		})
+	}
+}
+
+func TestNeedsUpgradeKeepsHigherCost(t *testing.T) {
+	strong := newService(t, config.Crypto{Iteration: 30})
+	weak := newService(t, config.Crypto{Iteration: 15})
+
+	encrypted, err := strong.Encrypt(secret.New("1234"), secret.New("login:password"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %s", err)
+	}
+
+	if weak.NeedsUpgrade(encrypted) {
+		t.Errorf("NeedsUpgrade() = true for an entry with a higher iteration count")
+	}
+}
+
+func TestWrappedKey(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	key, err := svc.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	wrappedKey, err := svc.WrapKey(secret.New("1234"), key)
+	if err != nil {
+		t.Fatalf("WrapKey() error = %s", err)
+	}
+
+	if _, err := svc.UnwrapKey(secret.New("4321"), wrappedKey); !errors.Is(err, crypto.ErrWrongPin) {
+		t.Errorf("UnwrapKey() error = %v, want %v", err, crypto.ErrWrongPin)
+	}
+
+	unwrappedKey, err := svc.UnwrapKey(secret.New("1234"), wrappedKey)
+	if err != nil {
+		t.Fatalf("UnwrapKey() error = %s", err)
+	}
+
+	encrypted, err := svc.EncryptWithKey(unwrappedKey, secret.New("login:password"))
+	if err != nil {
+		t.Fatalf("EncryptWithKey() error = %s", err)
+	}
+
+	if svc.NeedsPin(encrypted) || svc.NeedsUpgrade(encrypted) {
+		t.Errorf("NeedsPin() or NeedsUpgrade() = true for data sealed with a key")
+	}
+
+	got, err := svc.DecryptWithKey(key, encrypted)
+	if err != nil {
+		t.Fatalf("DecryptWithKey() error = %s", err)
+	}
+
+	if string(got.Bytes()) != "login:password" {
+		t.Errorf("DecryptWithKey() got = %q, want %q", got.Bytes(), "login:password")
+	}
+
+	if _, err := svc.Decrypt(secret.New("1234"), encrypted); err == nil {
+		t.Errorf("Decrypt() opened data sealed with a key")
+	}
+}
+
+func TestWrappedKeyWithCode(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	key, err := svc.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	wrappedKey, err := svc.WrapKeyWithCode(secret.New("ABCD-EFGH-JKMN-PQRS"), key)
+	if err != nil {
+		t.Fatalf("WrapKeyWithCode() error = %s", err)
+	}
+
+	if _, err := svc.UnwrapKey(secret.New("ABCD-EFGH-JKMN-PQRT"), wrappedKey); !errors.Is(err, crypto.ErrWrongPin) {
+		t.Errorf("UnwrapKey() error = %v, want %v", err, crypto.ErrWrongPin)
+	}
+
+	got, err := svc.UnwrapKey(secret.New("ABCD-EFGH-JKMN-PQRS"), wrappedKey)
+	if err != nil {
+		t.Fatalf("UnwrapKey() error = %s", err)
+	}
+
+	if !got.Equal(key) {
+		t.Errorf("UnwrapKey() returned another key")
+	}
+}
+
+func TestPepper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pepper.key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := crypto.LoadPepperKey(filepath.Join(t.TempDir(), "missing.key")); err == nil {
+		t.Errorf("LoadPepperKey() opened a missing key file")
+	}
+
+	key, err := crypto.LoadPepperKey(path)
+	if err != nil {
+		t.Fatalf("LoadPepperKey() error = %s", err)
+	}
+
+	svc, err := crypto.NewPepperService(key)
+	if err != nil {
+		t.Fatalf("NewPepperService() error = %s", err)
+	}
+
+	sealed, err := svc.Seal("cGcBAQ==")
+	if err != nil {
+		t.Fatalf("Seal() error = %s", err)
+	}
+
+	if keyId, ok := svc.KeyId(sealed); !ok || keyId != key.Id {
+		t.Errorf("KeyId() got = %q, want %q", keyId, key.Id)
+	}
+
+	for data, want := range map[string]string{sealed: "cGcBAQ==", "cGcBAQ==": "cGcBAQ=="} {
+		got, err := svc.Open(data)
+		if err != nil {
+			t.Fatalf("Open() error = %s", err)
+		}
+
+		if got != want {
+			t.Errorf("Open() got = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	svc := newService(t, config.Crypto{Iteration: 15})
+
+	key, err := svc.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	otherKey, err := svc.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	// Empty, shorter than a chunk, exactly one chunk and several chunks.
+	for _, size := range []int{0, 100, 64 << 10, 200 << 10} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+
+		var encrypted bytes.Buffer
+		if err := svc.EncryptStream(key, &encrypted, bytes.NewReader(data)); err != nil {
+			t.Fatalf("EncryptStream() error = %s", err)
+		}
+
+		var decrypted bytes.Buffer
+		if err := svc.DecryptStream(key, &decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+			t.Fatalf("DecryptStream() size %d error = %s", size, err)
+		}
+
+		if !bytes.Equal(decrypted.Bytes(), data) {
+			t.Errorf("DecryptStream() size %d got different data", size)
+		}
+
+		if err := svc.DecryptStream(otherKey, io.Discard, bytes.NewReader(encrypted.Bytes())); !errors.Is(err, crypto.ErrWrongPin) {
+			t.Errorf("DecryptStream() with another key error = %v, want %v", err, crypto.ErrWrongPin)
+		}
+
+		if size == 0 {
+			continue
+		}
+
+		tampered := bytes.Clone(encrypted.Bytes())
+		tampered[len(tampered)-1] ^= 1
+		if err := svc.DecryptStream(key, io.Discard, bytes.NewReader(tampered)); err == nil {
+			t.Errorf("DecryptStream() size %d opened a tampered stream", size)
+		}
+	}
+
+	data := make([]byte, 200<<10)
+	var encrypted bytes.Buffer
+	if err := svc.EncryptStream(key, &encrypted, bytes.NewReader(data)); err != nil {
+		t.Fatalf("EncryptStream() error = %s", err)
+	}
+
+	// Cut in the middle of a chunk, and right after a full chunk.
+	sealedChunk := 64<<10 + 16
+	for _, size := range []int{encrypted.Len() - 10, 36 + 2*sealedChunk, 36} {
+		if err := svc.DecryptStream(key, io.Discard, bytes.NewReader(encrypted.Bytes()[:size])); !errors.Is(err, crypto.ErrTruncatedStream) {
+			t.Errorf("DecryptStream() cut at %d error = %v, want %v", size, err, crypto.ErrTruncatedStream)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Every blob written by Encrypt starts with a fixed prefix:
+//
+//	magic (2 bytes) | version (1 byte) | algorithm id (1 byte)
+//
+// Since version 2 the prefix is followed by the key derivation params
+// (see KdfParams.marshal). The nonce and the sealed data come last, and
+// everything in front of the nonce is authenticated as additional data.
+// Legacy AES-CFB records start with a random IV instead, the magic keeps
+// the two apart.
+const (
+	versionNoKdf   byte = 1
+	versionKdf     byte = 2
+	currentVersion      = versionKdf
+	prefixSize          = 4
+)
+
+// Algorithm ids stored in the envelope.
+const (
+	AlgAES256GCM         byte = 1
+	AlgXChaCha20Poly1305 byte = 2
+)
+
+var envelopeMagic = [2]byte{'p', 'g'}
+
+type envelope struct {
+	version   byte
+	algorithm byte
+	kdf       *KdfParams
+	header    []byte
+	payload   []byte
+}
+
+func newEnvelope(algorithm byte, kdf KdfParams) *envelope {
+	e := &envelope{version: currentVersion, algorithm: algorithm, kdf: &kdf}
+	e.header = append([]byte{envelopeMagic[0], envelopeMagic[1], e.version, e.algorithm}, kdf.marshal()...)
+
+	return e
+}
+
+func (e *envelope) bytes() []byte {
+	blob := make([]byte, 0, len(e.header)+len(e.payload))
+	blob = append(blob, e.header...)
+
+	return append(blob, e.payload...)
+}
+
+// parseEnvelope splits blob into its parts. It returns false if blob does
+// not carry the envelope prefix, which means it is a legacy record. A blob
+// with the prefix but a version we don't know is an error, never a legacy
+// record, or a newer format could be opened without authentication.
+func parseEnvelope(blob []byte) (*envelope, bool, error) {
+	if len(blob) < prefixSize || blob[0] != envelopeMagic[0] || blob[1] != envelopeMagic[1] {
+		return nil, false, nil
+	}
+
+	e := &envelope{version: blob[2], algorithm: blob[3]}
+	headerSize := prefixSize
+
+	switch e.version {
+	case versionNoKdf:
+	case versionKdf:
+		kdf, n, err := unmarshalKdfParams(blob[prefixSize:])
+		if err != nil {
+			return nil, true, err
+		}
+
+		e.kdf = &kdf
+		headerSize += n
+	default:
+		return nil, true, fmt.Errorf("unknown envelope version %d", e.version)
+	}
+
+	e.header = blob[:headerSize]
+	e.payload = blob[headerSize:]
+
+	return e, true, nil
+}
+
+func newAEAD(algorithm byte, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(block)
+	case AlgXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+
+	return nil, errors.New("unknown encryption algorithm")
+}
+
+func seal(e *envelope, key, data []byte) error {
+	aead, err := newAEAD(e.algorithm, key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	e.payload = aead.Seal(nonce, nonce, data, e.header)
+
+	return nil
+}
+
+func open(e *envelope, key []byte) ([]byte, error) {
+	aead, err := newAEAD(e.algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.payload) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	// Any authentication failure means the key was wrong, or the data was
+	// tampered with, which we can't tell apart.
+	plaintext, err := aead.Open(nil, e.payload[:aead.NonceSize()], e.payload[aead.NonceSize():], e.header)
+	if err != nil {
+		return nil, ErrWrongPin
+	}
+
+	return plaintext, nil
+}
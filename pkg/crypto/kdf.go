@@ -0,0 +1,224 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"password-guard-bot/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation algorithm ids stored in the envelope. KdfNone marks data
+// sealed with a random key instead of a pin, it carries no params.
+// KdfHKDFSHA256 has no cost, it is only used for random codes that are
+// long enough on their own.
+const (
+	KdfNone         byte = 0
+	KdfPBKDF2SHA512 byte = 1
+	KdfArgon2id     byte = 2
+	KdfHKDFSHA256   byte = 3
+)
+
+var hkdfInfo = []byte("password-guard code")
+
+const (
+	saltSize  = 16
+	keyLength = 32
+
+	// The params are read back from stored data, a forged or corrupted
+	// record must not be able to stall the bot with a huge cost.
+	maxPBKDF2Iterations = defaultPBKDF2Ceiling
+	maxArgonTime        = 100
+	maxArgonMemory      = 1 << 20 // KiB, 1 GiB
+	maxArgonThreads     = 64
+)
+
+// KdfParams describes how an entry key was derived from a pin. They are
+// stored next to every entry, so decryption never depends on the current
+// configuration. For Argon2id Iterations is the time cost, Memory (KiB)
+// and Threads are only used by Argon2id.
+type KdfParams struct {
+	Algorithm  byte
+	Iterations uint32
+	Memory     uint32
+	Threads    uint8
+	KeyLength  byte
+	Salt       []byte
+}
+
+// newKdfParams builds the params used for new entries from the config.
+func newKdfParams(cfg *config.Crypto) (KdfParams, error) {
+	switch cfg.Kdf {
+	case "", "pbkdf2":
+		if cfg.Iteration <= 0 {
+			return KdfParams{}, errors.New("incorrect iteration")
+		}
+
+		return KdfParams{Algorithm: KdfPBKDF2SHA512, Iterations: uint32(cfg.Iteration), KeyLength: keyLength}, nil
+	case "argon2id":
+		if cfg.ArgonTime == 0 || cfg.ArgonMemory == 0 || cfg.ArgonThreads == 0 {
+			return KdfParams{}, errors.New("incorrect argon2id params")
+		}
+
+		return KdfParams{
+			Algorithm:  KdfArgon2id,
+			Iterations: cfg.ArgonTime,
+			Memory:     cfg.ArgonMemory,
+			Threads:    cfg.ArgonThreads,
+			KeyLength:  keyLength,
+		}, nil
+	}
+
+	return KdfParams{}, errors.New("unknown key derivation algorithm")
+}
+
+// withSalt returns a copy of the params with a fresh random salt.
+func (p KdfParams) withSalt() (KdfParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KdfParams{}, err
+	}
+
+	p.Salt = salt
+
+	return p, nil
+}
+
+func (p KdfParams) deriveKey(pin []byte) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	switch p.Algorithm {
+	case KdfPBKDF2SHA512:
+		return pbkdf2.Key(pin, p.Salt, int(p.Iterations), int(p.KeyLength), sha512.New), nil
+	case KdfArgon2id:
+		return argon2.IDKey(pin, p.Salt, p.Iterations, p.Memory, p.Threads, uint32(p.KeyLength)), nil
+	case KdfHKDFSHA256:
+		key := make([]byte, p.KeyLength)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, pin, p.Salt, hkdfInfo), key); err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	return nil, errors.New("unknown key derivation algorithm")
+}
+
+// validate checks that the cost is within the bounds we are willing to
+// pay for a single derivation.
+func (p KdfParams) validate() error {
+	switch p.Algorithm {
+	case KdfPBKDF2SHA512:
+		if p.Iterations == 0 || p.Iterations > maxPBKDF2Iterations {
+			return fmt.Errorf("pbkdf2 iteration count %d is out of range", p.Iterations)
+		}
+	case KdfArgon2id:
+		// argon2.IDKey panics on a zero time or thread count.
+		if p.Iterations == 0 || p.Iterations > maxArgonTime {
+			return fmt.Errorf("argon2id time %d is out of range", p.Iterations)
+		}
+		if p.Threads == 0 || p.Threads > maxArgonThreads {
+			return fmt.Errorf("argon2id thread count %d is out of range", p.Threads)
+		}
+		if p.Memory == 0 || p.Memory > maxArgonMemory {
+			return fmt.Errorf("argon2id memory %d KiB is out of range", p.Memory)
+		}
+	}
+
+	return nil
+}
+
+// weakerThan reports whether p uses another algorithm or a lower cost than
+// other. A higher cost is kept, a calibrated cost can drop when the bot
+// moves to a slower host.
+func (p KdfParams) weakerThan(other KdfParams) bool {
+	return p.Algorithm != other.Algorithm || p.Iterations < other.Iterations || p.Memory < other.Memory ||
+		p.KeyLength < other.KeyLength
+}
+
+// marshal encodes the params as:
+//
+//	PBKDF2:   algorithm (1) | iterations (4) | key length (1) | salt length (1) | salt
+//	Argon2id: algorithm (1) | time (4) | memory (4) | threads (1) | key length (1) | salt length (1) | salt
+//	HKDF:     algorithm (1) | key length (1) | salt length (1) | salt
+//	None:     algorithm (1)
+func (p KdfParams) marshal() []byte {
+	b := []byte{p.Algorithm}
+	if p.Algorithm == KdfNone {
+		return b
+	}
+
+	if p.Algorithm == KdfHKDFSHA256 {
+		b = append(b, p.KeyLength, byte(len(p.Salt)))
+
+		return append(b, p.Salt...)
+	}
+
+	b = binary.BigEndian.AppendUint32(b, p.Iterations)
+	if p.Algorithm == KdfArgon2id {
+		b = binary.BigEndian.AppendUint32(b, p.Memory)
+		b = append(b, p.Threads)
+	}
+	b = append(b, p.KeyLength, byte(len(p.Salt)))
+
+	return append(b, p.Salt...)
+}
+
+// unmarshalKdfParams decodes params written by marshal and returns the
+// number of bytes consumed.
+func unmarshalKdfParams(b []byte) (KdfParams, int, error) {
+	if len(b) == 0 {
+		return KdfParams{}, 0, errors.New("key derivation params too short")
+	}
+
+	if b[0] == KdfNone {
+		return KdfParams{Algorithm: KdfNone}, 1, nil
+	}
+
+	fixedSize := 7
+	switch b[0] {
+	case KdfArgon2id:
+		fixedSize = 12
+	case KdfHKDFSHA256:
+		fixedSize = 3
+	}
+
+	if len(b) < fixedSize {
+		return KdfParams{}, 0, errors.New("key derivation params too short")
+	}
+
+	p := KdfParams{Algorithm: b[0]}
+
+	rest := b[1:fixedSize]
+	if p.Algorithm != KdfHKDFSHA256 {
+		p.Iterations = binary.BigEndian.Uint32(rest[:4])
+		rest = rest[4:]
+	}
+	if p.Algorithm == KdfArgon2id {
+		p.Memory = binary.BigEndian.Uint32(rest[:4])
+		p.Threads = rest[4]
+		rest = rest[5:]
+	}
+	p.KeyLength = rest[0]
+
+	saltLen := int(rest[1])
+	if len(b) < fixedSize+saltLen {
+		return KdfParams{}, 0, errors.New("key derivation salt too short")
+	}
+	p.Salt = b[fixedSize : fixedSize+saltLen]
+
+	if err := p.validate(); err != nil {
+		return KdfParams{}, 0, err
+	}
+
+	return p, fixedSize + saltLen, nil
+}
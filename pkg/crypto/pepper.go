@@ -0,0 +1,212 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Data sealed by PepperService looks like
+//
+//	pk1:<key id>:<base64(nonce | ciphertext)>
+//
+// where the "pk1:<key id>" prefix is authenticated as additional data. The
+// colon never appears in base64, so sealed data can't be confused with the
+// output of CryptoService.
+const pepperPrefix = "pk1"
+
+// PepperService adds a second encryption layer with a key that only lives
+// on the server, so a leaked database alone is not enough to brute-force
+// short pins offline.
+type PepperService interface {
+	Seal(data string) (string, error)
+	Open(data string) (string, error)
+	KeyId(data string) (string, bool)
+	CurrentKeyId() string
+
+	AddKey(key *PepperKey)
+	SetCurrentKey(id string) error
+	RemoveKey(id string) error
+}
+
+// PepperKey is a server key loaded from a key file. The id is derived from
+// the key itself, so it never has to be configured.
+type PepperKey struct {
+	Id  string
+	key []byte
+}
+
+type pepper struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// LoadPepperKey reads a key file holding 32 random bytes encoded as
+// base64, e.g. the output of `head -c 32 /dev/urandom | base64`.
+func LoadPepperKey(path string) (*PepperKey, error) {
+	if path == "" {
+		return nil, errors.New("invalid pepper key file path")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pepper key: %w", err)
+	}
+
+	if len(key) != keyLength {
+		return nil, fmt.Errorf("pepper key must be %d bytes", keyLength)
+	}
+
+	sum := sha256.Sum256(key)
+
+	return &PepperKey{Id: hex.EncodeToString(sum[:4]), key: key}, nil
+}
+
+// NewPepperService seals new data with current, the other keys are only
+// used to open data sealed before.
+func NewPepperService(current *PepperKey, other ...*PepperKey) (PepperService, error) {
+	if current == nil {
+		return nil, errors.New("invalid pepper key")
+	}
+
+	keys := map[string][]byte{current.Id: current.key}
+	for _, k := range other {
+		keys[k.Id] = k.key
+	}
+
+	return &pepper{current: current.Id, keys: keys}, nil
+}
+
+func (p *pepper) Seal(data string) (string, error) {
+	p.mu.RLock()
+	current, key := p.current, p.keys[p.current]
+	p.mu.RUnlock()
+
+	aead, err := newAEAD(AlgAES256GCM, key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	header := pepperPrefix + ":" + current
+	sealed := aead.Seal(nonce, nonce, []byte(data), []byte(header))
+
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open removes the server layer. Data that was stored before the layer
+// existed is returned as is.
+func (p *pepper) Open(data string) (string, error) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[0] != pepperPrefix {
+		return data, nil
+	}
+
+	p.mu.RLock()
+	key, ok := p.keys[parts[1]]
+	p.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown pepper key id %q", parts[1])
+	}
+
+	aead, err := newAEAD(AlgAES256GCM, key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+
+	header := pepperPrefix + ":" + parts[1]
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(header))
+	if err != nil {
+		return "", errors.New("failed to open pepper layer")
+	}
+
+	return string(plaintext), nil
+}
+
+// KeyId returns the id of the key data is sealed with, false means data
+// has no server layer.
+func (p *pepper) KeyId(data string) (string, bool) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[0] != pepperPrefix {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// PepperKeyPrefix returns the prefix of data sealed with the key id, to
+// look for such data in storage.
+func PepperKeyPrefix(id string) string {
+	return pepperPrefix + ":" + id + ":"
+}
+
+func (p *pepper) CurrentKeyId() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.current
+}
+
+// AddKey makes key available to Open, it is not used by Seal until it is
+// set as the current key.
+func (p *pepper) AddKey(key *PepperKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys[key.Id] = key.key
+}
+
+func (p *pepper) SetCurrentKey(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.keys[id]; !ok {
+		return fmt.Errorf("unknown pepper key id %q", id)
+	}
+
+	p.current = id
+
+	return nil
+}
+
+// RemoveKey retires a key, data still sealed with it can't be opened
+// anymore.
+func (p *pepper) RemoveKey(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id == p.current {
+		return errors.New("can't remove the current pepper key")
+	}
+
+	delete(p.keys, id)
+
+	return nil
+}
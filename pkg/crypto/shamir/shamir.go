@@ -0,0 +1,157 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8), one
+// polynomial per byte of the secret.
+//
+// A share is the value of every polynomial at one point followed by the
+// point itself, so it is one byte longer than the secret. The arithmetic
+// uses the AES field (x^8 + x^4 + x^3 + x + 1) and runs in constant time,
+// without lookup tables.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxShares is the number of distinct non-zero points in the field.
+const MaxShares = 255
+
+var (
+	ErrInvalidThreshold = errors.New("invalid threshold")
+	ErrInvalidShares    = errors.New("invalid shares")
+)
+
+// Split splits secret into n shares, any k of which reconstruct it. Fewer
+// than k shares tell nothing about the secret.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	return split(rand.Reader, secret, n, k)
+}
+
+func split(random io.Reader, secret []byte, n, k int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	if k < 2 || k > n || n > MaxShares {
+		return nil, fmt.Errorf("%w: %d of %d", ErrInvalidThreshold, k, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	// coefficients[0] is the secret byte, the rest are random.
+	coefficients := make([]byte, k)
+	defer clear(coefficients)
+
+	for b, value := range secret {
+		coefficients[0] = value
+		if _, err := io.ReadFull(random, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range shares {
+			share[b] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine reconstructs the secret from k or more shares of the same split.
+// Shares of different splits, or fewer than k of them, give a wrong secret
+// without an error; the caller has to check the result.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%w: need at least 2", ErrInvalidShares)
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidShares)
+	}
+
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, fmt.Errorf("%w: different lengths", ErrInvalidShares)
+		}
+
+		x := share[size-1]
+		if x == 0 {
+			return nil, fmt.Errorf("%w: zero point", ErrInvalidShares)
+		}
+
+		for _, other := range xs[:i] {
+			if other == x {
+				return nil, fmt.Errorf("%w: duplicate point %d", ErrInvalidShares, x)
+			}
+		}
+
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at 0. In GF(2^8) subtraction is addition, so
+	// the basis polynomial for point i is the product of xj / (xj + xi).
+	basis := make([]byte, len(shares))
+	for i, xi := range xs {
+		basis[i] = 1
+		for j, xj := range xs {
+			if i != j {
+				basis[i] = mul(basis[i], div(xj, xj^xi))
+			}
+		}
+	}
+
+	secret := make([]byte, size-1)
+	for b := range secret {
+		for i, share := range shares {
+			secret[b] ^= mul(share[b], basis[i])
+		}
+	}
+
+	return secret, nil
+}
+
+// evaluate returns the polynomial at x, by Horner's rule.
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+
+	return y
+}
+
+// mul multiplies in GF(2^8) with the AES reduction polynomial.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		// All ones when the low bit of b is set, all zeros otherwise.
+		p ^= a & -(b & 1)
+		b >>= 1
+
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+	}
+
+	return p
+}
+
+// inverse returns a^254, which is 1/a for any a but 0.
+func inverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = mul(a, a)
+		result = mul(result, a)
+	}
+
+	return result
+}
+
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
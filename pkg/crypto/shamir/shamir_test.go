@@ -0,0 +1,172 @@
+package shamir_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"password-guard-bot/pkg/crypto/shamir"
+	"testing"
+)
+
+// The vectors were computed with an independent implementation over the
+// AES field. The first one uses the FIPS-197 example bytes 0x57 and 0x83
+// as coefficients.
+var vectors = []struct {
+	name      string
+	secret    string
+	threshold int
+	shares    []string
+}{
+	{
+		name:      "2 of 3",
+		secret:    hex.EncodeToString([]byte("pg")),
+		threshold: 2,
+		shares:    []string{"27e401", "de7a02", "89f903"},
+	},
+	{
+		name:      "3 of 5",
+		secret:    hex.EncodeToString([]byte("secret")),
+		threshold: 3,
+		shares:    []string{"7062607d217401", "7973715c874002", "7a747253c34003", "572917ee09cc04", "542e14e14dcc05"},
+	},
+	{
+		name:      "4 of 6, 256 bit key",
+		secret:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		threshold: 4,
+		shares: []string{
+			"51adaca95003577f8b5af665328006416a9e004e03e41939d7f5053d2acc837f01",
+			"54fe511ded9bee0808cfd8c9fd248818df715a99f3a57ea1413cacd620a984aa02",
+			"3f3e6aefdcecc04f4f24ad28608d0433ef1545ddaa84df0265343eceb8bad4c703",
+			"381305ec57d2a8e9b5a62bce9319c9be86edcd33679385ef4499719dbfeb964504",
+			"f5ccf88d46e9e0139848ccaf4a4cf4b55b2ef138cfb443c2c71b6d3f4080930b05",
+			"a7a19204bbe99505cfd7dd180d0b03ac2f94ed71c6f9ea5d04ddc3bb84153e9806",
+		},
+	},
+}
+
+func TestCombineVectors(t *testing.T) {
+	for _, vector := range vectors {
+		t.Run(vector.name, func(t *testing.T) {
+			want := mustDecode(t, vector.secret)
+
+			var shares [][]byte
+			for _, share := range vector.shares {
+				shares = append(shares, mustDecode(t, share))
+			}
+
+			// Every subset of at least threshold shares, in any order, gives
+			// the secret; smaller subsets don't.
+			for mask := 1; mask < 1<<len(shares); mask++ {
+				var subset [][]byte
+				for i := len(shares) - 1; i >= 0; i-- {
+					if mask&(1<<i) != 0 {
+						subset = append(subset, shares[i])
+					}
+				}
+
+				if len(subset) < 2 {
+					continue
+				}
+
+				got, err := shamir.Combine(subset)
+				if err != nil {
+					t.Fatalf("Combine() error = %s", err)
+				}
+
+				if enough := len(subset) >= vector.threshold; enough != bytes.Equal(got, want) {
+					t.Errorf("Combine() of %d shares got = %x, want %x: %t", len(subset), got, want, enough)
+				}
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := shamir.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split() error = %s", err)
+	}
+
+	if len(shares) != 5 {
+		t.Fatalf("Split() got %d shares, want 5", len(shares))
+	}
+
+	for i, share := range shares {
+		if len(share) != len(secret)+1 || share[len(secret)] != byte(i+1) {
+			t.Errorf("share %d = %x", i, share)
+		}
+	}
+
+	got, err := shamir.Combine([][]byte{shares[4], shares[0], shares[2]})
+	if err != nil {
+		t.Fatalf("Combine() error = %s", err)
+	}
+
+	if !bytes.Equal(got, secret) {
+		t.Errorf("Combine() got = %x, want %x", got, secret)
+	}
+
+	// The most shares the field allows.
+	shares, err = shamir.Split(secret, shamir.MaxShares, shamir.MaxShares)
+	if err != nil {
+		t.Fatalf("Split() error = %s", err)
+	}
+
+	if got, err := shamir.Combine(shares); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("Combine() of %d shares got = %x, %v", shamir.MaxShares, got, err)
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	tests := []struct {
+		n, k int
+	}{
+		{3, 1},
+		{2, 3},
+		{shamir.MaxShares + 1, 2},
+		{0, 0},
+	}
+
+	for _, test := range tests {
+		if _, err := shamir.Split([]byte("secret"), test.n, test.k); !errors.Is(err, shamir.ErrInvalidThreshold) {
+			t.Errorf("Split(%d of %d) error = %v, want %v", test.k, test.n, err, shamir.ErrInvalidThreshold)
+		}
+	}
+
+	if _, err := shamir.Split(nil, 3, 2); err == nil {
+		t.Errorf("Split() accepted an empty secret")
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	tests := map[string][][]byte{
+		"one share":        {{1, 1}},
+		"different length": {{1, 1}, {1, 2, 2}},
+		"zero point":       {{1, 0}, {1, 2}},
+		"duplicate point":  {{1, 1}, {2, 1}},
+		"too short":        {{1}, {2}},
+	}
+
+	for name, shares := range tests {
+		if _, err := shamir.Combine(shares); !errors.Is(err, shamir.ErrInvalidShares) {
+			t.Errorf("Combine() with %s error = %v, want %v", name, err, shamir.ErrInvalidShares)
+		}
+	}
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
@@ -0,0 +1,208 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"password-guard-bot/pkg/secret"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A stream written by EncryptStream starts with its own header:
+//
+//	magic (2 bytes) | version (1 byte) | algorithm id (1 byte) | salt (32 bytes)
+//
+// followed by chunks of streamChunkSize plaintext bytes, each sealed on its
+// own. Every stream gets a key of its own, derived from the caller's key and
+// the salt, so the nonce can simply count the chunks. The last byte of the
+// nonce marks the final chunk, a stream cut at a chunk boundary doesn't
+// open. The header is authenticated with every chunk.
+const (
+	streamVersion    byte = 1
+	streamSaltSize        = 32
+	streamHeaderSize      = prefixSize + streamSaltSize
+	streamChunkSize       = 64 << 10
+)
+
+var streamMagic = [2]byte{'p', 's'}
+
+var streamInfo = []byte("password-guard stream")
+
+// ErrTruncatedStream is returned by DecryptStream when the stream ends
+// before its final chunk.
+var ErrTruncatedStream = errors.New("stream is truncated")
+
+func (c *crypto) EncryptStream(key secret.Secret, dst io.Writer, src io.Reader) error {
+	header := make([]byte, streamHeaderSize)
+	header[0], header[1], header[2], header[3] = streamMagic[0], streamMagic[1], streamVersion, AlgAES256GCM
+	if _, err := io.ReadFull(rand.Reader, header[prefixSize:]); err != nil {
+		return err
+	}
+
+	s, err := newStreamCipher(key.Bytes(), header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, streamChunkSize)
+	chunk := make([]byte, streamChunkSize)
+	defer secret.Wipe(chunk)
+
+	sealed := make([]byte, 0, streamChunkSize+s.aead.Overhead())
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			// A full chunk is the last one if nothing follows it.
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = s.seal(sealed[:0], chunk[:n], last)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptStream writes each chunk to dst once it is authenticated. On error
+// dst may already hold the start of the plaintext, the caller drops it.
+func (c *crypto) DecryptStream(key secret.Secret, dst io.Writer, src io.Reader) error {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncatedStream
+		}
+
+		return err
+	}
+
+	if header[0] != streamMagic[0] || header[1] != streamMagic[1] || header[2] != streamVersion {
+		return errors.New("unknown stream format")
+	}
+
+	s, err := newStreamCipher(key.Bytes(), header)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, streamChunkSize+s.aead.Overhead())
+	sealed := make([]byte, streamChunkSize+s.aead.Overhead())
+
+	plaintext := make([]byte, 0, streamChunkSize)
+	defer secret.Wipe(plaintext[:cap(plaintext)])
+
+	for {
+		n, err := io.ReadFull(r, sealed)
+		if err == io.EOF {
+			return ErrTruncatedStream
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		plaintext, err = s.open(plaintext[:0], sealed[:n], last)
+		if err != nil {
+			return err
+		}
+
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+type streamCipher struct {
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint64
+}
+
+func newStreamCipher(key, header []byte) (*streamCipher, error) {
+	if len(key) != keyLength {
+		return nil, errors.New("invalid stream key")
+	}
+
+	streamKey := make([]byte, keyLength)
+	defer secret.Wipe(streamKey)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, header[prefixSize:], streamInfo), streamKey); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(header[3], streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamCipher{aead: aead, header: header, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (s *streamCipher) seal(dst, chunk []byte, last bool) []byte {
+	s.next(last)
+
+	return s.aead.Seal(dst, s.nonce, chunk, s.header)
+}
+
+func (s *streamCipher) open(dst, sealed []byte, last bool) ([]byte, error) {
+	s.next(last)
+
+	// Same as open: a wrong key and a tampered chunk look alike. Once the
+	// first chunk opened the key is right, a later final chunk that doesn't
+	// open most likely means the rest was cut off.
+	plaintext, err := s.aead.Open(dst, s.nonce, sealed, s.header)
+	if err != nil {
+		if last && s.counter > 1 {
+			return nil, ErrTruncatedStream
+		}
+
+		return nil, ErrWrongPin
+	}
+
+	return plaintext, nil
+}
+
+// next sets the nonce for the next chunk: the chunk counter followed by the
+// final chunk flag.
+func (s *streamCipher) next(last bool) {
+	clear(s.nonce)
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-9:], s.counter)
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.counter++
+}
@@ -0,0 +1,163 @@
+// Package fuzzy ranks names against a search query the way people type
+// them: the start of the name, the start of a word in it, any part of it,
+// or with a typo.
+package fuzzy
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Score tiers, every match of a better kind ranks above any match of a
+// worse kind.
+const (
+	scoreExact      = 1000
+	scorePrefix     = 900
+	scoreWordPrefix = 700
+	scoreSubstring  = 500
+	scoreTypo       = 300
+
+	// maxPenalty keeps a penalty within the gap between two tiers.
+	maxPenalty = 99
+)
+
+// Match scores how well name matches query, case-insensitively. A higher
+// score is a better match, ok is false if name doesn't match at all.
+func Match(query, name string) (int, bool) {
+	q := []rune(strings.ToLower(strings.TrimSpace(query)))
+	n := []rune(strings.ToLower(name))
+
+	if len(q) == 0 {
+		return 0, false
+	}
+
+	if string(q) == string(n) {
+		return scoreExact, true
+	}
+
+	if hasPrefix(n, q) {
+		return scorePrefix - penalty(len(n)-len(q)), true
+	}
+
+	words := wordStarts(n)
+	for _, start := range words {
+		if hasPrefix(n[start:], q) {
+			return scoreWordPrefix - penalty(start), true
+		}
+	}
+
+	if i := strings.Index(string(n), string(q)); i >= 0 {
+		return scoreSubstring - penalty(len([]rune(string(n)[:i]))), true
+	}
+
+	allowed := allowedTypos(len(q))
+	if allowed == 0 {
+		return 0, false
+	}
+
+	// A typo in the whole name, in one of its words, or in as much of its
+	// start as was typed.
+	best := allowed + 1
+	candidates := [][]rune{n, n[:min(len(q), len(n))]}
+	starts := append([]int{0}, words...)
+	for i, start := range starts {
+		end := len(n)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		candidates = append(candidates, trimWord(n[start:end]))
+	}
+
+	for _, candidate := range candidates {
+		best = min(best, Distance(string(q), string(candidate)))
+	}
+
+	if best > allowed {
+		return 0, false
+	}
+
+	return scoreTypo - 50*best, true
+}
+
+// Distance is the number of inserted, deleted, replaced or swapped
+// adjacent runes needed to turn a into b.
+func Distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+
+	// Three rows are enough: the current one, the previous one for
+	// replacements and the one before it for swaps.
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(t)]
+}
+
+// allowedTypos grows with the query, a typo in two letters would match
+// almost anything.
+func allowedTypos(length int) int {
+	switch {
+	case length < 3:
+		return 0
+	case length < 6:
+		return 1
+	case length < 10:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// wordStarts returns where the words of name start after the first one,
+// at separators like "-", "_", "." or a space.
+func wordStarts(name []rune) []int {
+	var starts []int
+	for i := 1; i < len(name); i++ {
+		if isSeparator(name[i-1]) && !isSeparator(name[i]) {
+			starts = append(starts, i)
+		}
+	}
+
+	return starts
+}
+
+func trimWord(word []rune) []rune {
+	for len(word) > 0 && isSeparator(word[len(word)-1]) {
+		word = word[:len(word)-1]
+	}
+
+	return word
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+func hasPrefix(s, prefix []rune) bool {
+	return len(s) >= len(prefix) && string(s[:len(prefix)]) == string(prefix)
+}
+
+func penalty(n int) int {
+	return min(n, maxPenalty)
+}
@@ -0,0 +1,72 @@
+package fuzzy_test
+
+import (
+	"password-guard-bot/pkg/fuzzy"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		target string
+		wantOk bool
+	}{
+		{name: "Exact", query: "github", target: "GitHub", wantOk: true},
+		{name: "Prefix", query: "git", target: "github-work", wantOk: true},
+		{name: "Word prefix", query: "work", target: "github-work", wantOk: true},
+		{name: "Substring", query: "hub", target: "github-work", wantOk: true},
+		{name: "Typo", query: "githbu", target: "github-work", wantOk: true},
+		{name: "Typo in a word", query: "wrok", target: "github-work", wantOk: true},
+		{name: "Too many typos", query: "gtihbu", target: "gitlab", wantOk: false},
+		{name: "Short query without typos", query: "gx", target: "github", wantOk: false},
+		{name: "Empty query", query: " ", target: "github", wantOk: false},
+		{name: "Unrelated", query: "bank", target: "github-work", wantOk: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := fuzzy.Match(test.query, test.target); ok != test.wantOk {
+				t.Errorf("Match(%q, %q) ok = %v, want %v", test.query, test.target, ok, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestMatchRanking(t *testing.T) {
+	// Each name should rank above the next one for the query "git".
+	ranked := []string{"git", "github", "github-enterprise", "my-git", "legit", "gti"}
+
+	previous := 0
+	for i, name := range ranked {
+		score, ok := fuzzy.Match("git", name)
+		if !ok {
+			t.Fatalf("Match(%q, %q) didn't match", "git", name)
+		}
+
+		if i > 0 && score >= previous {
+			t.Errorf("Match(%q, %q) = %d, want below %d of %q", "git", name, score, previous, ranked[i-1])
+		}
+		previous = score
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"github", "githbu", 1},
+		{"ab", "ba", 1},
+		{"пароль", "парль", 1},
+	}
+
+	for _, test := range tests {
+		if got := fuzzy.Distance(test.a, test.b); got != test.want {
+			t.Errorf("Distance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
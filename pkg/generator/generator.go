@@ -0,0 +1,193 @@
+package generator
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	lowerChars  = "abcdefghijklmnopqrstuvwxyz"
+	upperChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars  = "0123456789"
+	symbolChars = "!@#$%^&*()-_=+[]{};:,.?/"
+
+	// Characters that are easy to mix up when a password is read or typed.
+	ambiguousChars = "Il1O0o|`'\";:,."
+)
+
+const (
+	MinLength = 8
+	MaxLength = 64
+	MinWords  = 4
+	MaxWords  = 10
+)
+
+// wordlist.txt is the BIP-39 English wordlist, 2048 words give 11 bits of
+// entropy per word.
+//
+//go:embed wordlist.txt
+var wordlist string
+
+var words = strings.Fields(wordlist)
+
+// Options describe what Generate produces. With Passphrase set only Words
+// and Separator are used.
+type Options struct {
+	Length           int
+	Lower            bool
+	Upper            bool
+	Digits           bool
+	Symbols          bool
+	ExcludeAmbiguous bool
+	Passphrase       bool
+	Words            int
+	Separator        string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Length:           20,
+		Lower:            true,
+		Upper:            true,
+		Digits:           true,
+		Symbols:          true,
+		ExcludeAmbiguous: true,
+		Words:            5,
+		Separator:        "-",
+	}
+}
+
+type Generator interface {
+	Generate(options Options) (string, error)
+}
+
+type generator struct{}
+
+func NewGenerator() Generator {
+	return &generator{}
+}
+
+func (g *generator) Generate(options Options) (string, error) {
+	if options.Passphrase {
+		return passphrase(options)
+	}
+
+	return password(options)
+}
+
+func password(options Options) (string, error) {
+	if options.Length < MinLength || options.Length > MaxLength {
+		return "", errors.New("invalid password length")
+	}
+
+	var classes []string
+	for _, class := range []struct {
+		enabled bool
+		chars   string
+	}{
+		{options.Lower, lowerChars},
+		{options.Upper, upperChars},
+		{options.Digits, digitChars},
+		{options.Symbols, symbolChars},
+	} {
+		if !class.enabled {
+			continue
+		}
+
+		chars := class.chars
+		if options.ExcludeAmbiguous {
+			chars = removeChars(chars, ambiguousChars)
+		}
+		classes = append(classes, chars)
+	}
+
+	if len(classes) == 0 {
+		return "", errors.New("no character classes selected")
+	}
+
+	// One character from every class first, so each selected class is
+	// guaranteed to appear, the rest from all of them.
+	result := make([]byte, 0, options.Length)
+	for _, chars := range classes {
+		c, err := pick(chars)
+		if err != nil {
+			return "", err
+		}
+		result = append(result, c)
+	}
+
+	all := strings.Join(classes, "")
+	for len(result) < options.Length {
+		c, err := pick(all)
+		if err != nil {
+			return "", err
+		}
+		result = append(result, c)
+	}
+
+	if err := shuffle(result); err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+func passphrase(options Options) (string, error) {
+	if options.Words < MinWords || options.Words > MaxWords {
+		return "", errors.New("invalid number of words")
+	}
+
+	chosen := make([]string, 0, options.Words)
+	for i := 0; i < options.Words; i++ {
+		n, err := randInt(len(words))
+		if err != nil {
+			return "", err
+		}
+		chosen = append(chosen, words[n])
+	}
+
+	return strings.Join(chosen, options.Separator), nil
+}
+
+func removeChars(chars, remove string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(remove, r) {
+			return -1
+		}
+		return r
+	}, chars)
+}
+
+func pick(chars string) (byte, error) {
+	n, err := randInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+
+	return chars[n], nil
+}
+
+// shuffle is a Fisher-Yates shuffle driven by crypto/rand.
+func shuffle(b []byte) error {
+	for i := len(b) - 1; i > 0; i-- {
+		j, err := randInt(i + 1)
+		if err != nil {
+			return err
+		}
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return nil
+}
+
+func randInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
+}
@@ -0,0 +1,83 @@
+package generator_test
+
+import (
+	"password-guard-bot/pkg/generator"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	gen := generator.NewGenerator()
+
+	tests := []struct {
+		name      string
+		options   func(o *generator.Options)
+		check     func(t *testing.T, got string)
+		wantError bool
+	}{
+		{
+			name: "Default password",
+			check: func(t *testing.T, got string) {
+				if len(got) != 20 {
+					t.Errorf("Generate() length = %d, want 20", len(got))
+				}
+
+				for _, chars := range []string{"abcdefghijkmnpqrstuvwxyz", "ABCDEFGHJKLMNPQRSTUVWXYZ", "23456789", "!@#$%^&*()-_=+[]{}?/"} {
+					if !strings.ContainsAny(got, chars) {
+						t.Errorf("Generate() = %q has no characters from %q", got, chars)
+					}
+				}
+
+				if strings.ContainsAny(got, "Il1O0o|`'\";:,.") {
+					t.Errorf("Generate() = %q has ambiguous characters", got)
+				}
+			},
+		},
+		{
+			name:    "Digits only",
+			options: func(o *generator.Options) { o.Lower, o.Upper, o.Symbols, o.Length = false, false, false, 12 },
+			check: func(t *testing.T, got string) {
+				if len(got) != 12 || strings.Trim(got, "23456789") != "" {
+					t.Errorf("Generate() = %q, want 12 digits", got)
+				}
+			},
+		},
+		{
+			name:    "Passphrase",
+			options: func(o *generator.Options) { o.Passphrase, o.Words = true, 6 },
+			check: func(t *testing.T, got string) {
+				if words := strings.Split(got, "-"); len(words) != 6 {
+					t.Errorf("Generate() = %q, want 6 words", got)
+				}
+			},
+		},
+		{
+			name:      "No character classes",
+			options:   func(o *generator.Options) { o.Lower, o.Upper, o.Digits, o.Symbols = false, false, false, false },
+			wantError: true,
+		},
+		{
+			name:      "Too short",
+			options:   func(o *generator.Options) { o.Length = 4 },
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := generator.DefaultOptions()
+			if test.options != nil {
+				test.options(&options)
+			}
+
+			got, err := gen.Generate(options)
+			if (err != nil) != test.wantError {
+				t.Fatalf("Generate() error = %v, wantErr %v", err, test.wantError)
+			}
+
+			if test.check != nil {
+				test.check(t, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+)
+
+const redacted = "[REDACTED]"
+
+// Secret holds a pin, a password or a key. It never prints its content:
+// fmt verbs, zap fields and JSON all show a placeholder, Bytes is the only
+// way to read it. Wipe zeroes the bytes once the secret is no longer
+// needed, copies of a Secret share them.
+//
+// Strings can't be wiped, so a Secret made by New only protects the copy it
+// holds, not the string it was made from.
+type Secret struct {
+	b []byte
+}
+
+func New(s string) Secret {
+	if s == "" {
+		return Secret{}
+	}
+
+	return Secret{b: []byte(s)}
+}
+
+// FromBytes takes ownership of b, it is wiped together with the secret.
+func FromBytes(b []byte) Secret {
+	return Secret{b: b}
+}
+
+// Bytes returns the content itself, not a copy.
+func (s Secret) Bytes() []byte {
+	return s.b
+}
+
+func (s Secret) Len() int {
+	return len(s.b)
+}
+
+func (s Secret) IsEmpty() bool {
+	return len(s.b) == 0
+}
+
+// Equal compares in constant time.
+func (s Secret) Equal(other Secret) bool {
+	return subtle.ConstantTimeCompare(s.b, other.b) == 1
+}
+
+// TrimSpace returns a new secret without leading and trailing white space,
+// s stays as it is.
+func (s Secret) TrimSpace() Secret {
+	trimmed := bytes.TrimSpace(s.b)
+	if len(trimmed) == 0 {
+		return Secret{}
+	}
+
+	return Secret{b: append([]byte(nil), trimmed...)}
+}
+
+// Clone returns a new secret with the same content, wiping one leaves the
+// other as it is.
+func (s Secret) Clone() Secret {
+	if len(s.b) == 0 {
+		return Secret{}
+	}
+
+	return Secret{b: append([]byte(nil), s.b...)}
+}
+
+// Wipe zeroes the content and empties s.
+func (s *Secret) Wipe() {
+	Wipe(s.b)
+	s.b = nil
+}
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// Format covers every verb, so %x or %q don't leak the content either.
+func (s Secret) Format(f fmt.State, verb rune) {
+	_, _ = f.Write([]byte(redacted))
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// Wipe zeroes b, for key material that isn't kept in a Secret.
+func Wipe(b []byte) {
+	clear(b)
+}
@@ -0,0 +1,127 @@
+package secret_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"password-guard-bot/pkg/secret"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const password = "hunter2-correct-horse"
+
+type state struct {
+	Login    string
+	Password secret.Secret
+	Pin      *secret.Secret
+}
+
+func TestFormatIsRedacted(t *testing.T) {
+	s := secret.New(password)
+	st := state{Login: "alice", Password: s, Pin: &s}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		for _, value := range []any{s, &s, st, &st} {
+			got := fmt.Sprintf(format, value)
+			if strings.Contains(got, password) || strings.Contains(strings.ToLower(got), hex.EncodeToString([]byte(password))) {
+				t.Errorf("Sprintf(%q, %T) = %s leaks the secret", format, value, got)
+			}
+		}
+	}
+
+	if got := fmt.Sprint(st); !strings.Contains(got, "alice") || !strings.Contains(got, "[REDACTED]") {
+		t.Errorf("Sprint() = %s, want the login and the placeholder", got)
+	}
+}
+
+func TestZapIsRedacted(t *testing.T) {
+	var buf bytes.Buffer
+
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zapcore.DebugLevel)
+	logger := zap.New(core)
+
+	s := secret.New(password)
+	st := state{Login: "alice", Password: s, Pin: &s}
+
+	logger.Info("fields", zap.Any("secret", s), zap.Any("pointer", &s), zap.Any("state", st), zap.Stringer("stringer", s))
+	logger.Sugar().Infof("sugared %v %s %+v", s, &s, st)
+	logger.Sugar().Infow("sugared fields", "secret", s, "state", &st)
+
+	if err := logger.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), password) {
+		t.Errorf("zap output leaks the secret:\n%s", buf.String())
+	}
+
+	if !strings.Contains(buf.String(), "[REDACTED]") {
+		t.Errorf("zap output has no placeholder:\n%s", buf.String())
+	}
+}
+
+func TestJSONIsRedacted(t *testing.T) {
+	s := secret.New(password)
+
+	got, err := json.Marshal(state{Login: "alice", Password: s, Pin: &s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(got), password) {
+		t.Errorf("json.Marshal() = %s leaks the secret", got)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	s := secret.New(password)
+	b := s.Bytes()
+	shared := s
+
+	s.Wipe()
+
+	if !s.IsEmpty() {
+		t.Errorf("Wipe() left %d bytes", s.Len())
+	}
+
+	if !bytes.Equal(b, make([]byte, len(password))) {
+		t.Errorf("Wipe() did not zero the bytes: %q", b)
+	}
+
+	if !bytes.Equal(shared.Bytes(), make([]byte, len(password))) {
+		t.Errorf("Wipe() did not zero the bytes of a copy")
+	}
+}
+
+func TestTrimSpace(t *testing.T) {
+	s := secret.New("  1234\n")
+	trimmed := s.TrimSpace()
+
+	if !trimmed.Equal(secret.New("1234")) {
+		t.Errorf("TrimSpace() = %q", trimmed.Bytes())
+	}
+
+	trimmed.Wipe()
+	if string(s.Bytes()) != "  1234\n" {
+		t.Errorf("TrimSpace() changed the original: %q", s.Bytes())
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := secret.New("  line one\nline two\n")
+	clone := s.Clone()
+
+	if !clone.Equal(s) {
+		t.Errorf("Clone() = %q", clone.Bytes())
+	}
+
+	clone.Wipe()
+	if string(s.Bytes()) != "  line one\nline two\n" {
+		t.Errorf("wiping the clone changed the original: %q", s.Bytes())
+	}
+}
@@ -0,0 +1,476 @@
+package strength
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// common.txt lists common passwords and words, most common first. The rank
+// in the list is how many guesses an attacker needs to reach it.
+//
+//go:embed common.txt
+var commonList string
+
+var common = rankedDictionary(strings.Fields(commonList))
+
+// Score thresholds in bits, zxcvbn uses the same ones as guess counts:
+// 10^3, 10^6, 10^8 and 10^10.
+var thresholds = []float64{10, 20, 26.6, 33.2}
+
+const (
+	// MinLength is the length below which a longer password is suggested
+	// even if it scores well.
+	MinLength = 12
+
+	// Acceptable is the lowest score that doesn't need a warning.
+	Acceptable = 3
+
+	maxWordLength = 20
+)
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+var leetSubstitutions = map[rune][]rune{
+	'4': {'a'},
+	'@': {'a'},
+	'8': {'b'},
+	'3': {'e'},
+	'6': {'g'},
+	'1': {'i', 'l'},
+	'!': {'i'},
+	'0': {'o'},
+	'$': {'s'},
+	'5': {'s'},
+	'7': {'t'},
+	'+': {'t'},
+	'2': {'z'},
+}
+
+type kind int
+
+const (
+	kindCommon kind = iota
+	kindUserInput
+	kindRepeat
+	kindSequence
+	kindKeyboard
+	kindYear
+)
+
+type match struct {
+	start, end int
+	kind       kind
+	bits       float64
+	leet       bool
+}
+
+// Result is the outcome of Estimate. Score goes from 0 (guessed almost
+// instantly) to 4 (very hard to guess).
+type Result struct {
+	Score       int
+	Entropy     float64
+	Warning     string
+	Suggestions []string
+}
+
+type Estimator interface {
+	Estimate(password string, userInputs ...string) Result
+}
+
+type estimator struct{}
+
+func NewEstimator() Estimator {
+	return &estimator{}
+}
+
+// Estimate splits password into the cheapest sequence of known patterns
+// and brute forced characters and scores the total number of bits. Words in
+// userInputs, like the login, are treated as the first guesses.
+func (e *estimator) Estimate(password string, userInputs ...string) Result {
+	runes := []rune(password)
+
+	inputs := make(map[string]int)
+	for _, input := range userInputs {
+		for _, word := range strings.FieldsFunc(strings.ToLower(input), isSeparator) {
+			if len([]rune(word)) >= 3 {
+				inputs[word] = 1
+			}
+		}
+	}
+
+	path, bits := cheapestPath(runes, inputs)
+
+	result := Result{Entropy: math.Round(bits*10) / 10}
+	for result.Score < len(thresholds) && bits >= thresholds[result.Score] {
+		result.Score++
+	}
+
+	result.Warning, result.Suggestions = feedback(runes, path, result.Score)
+
+	return result
+}
+
+// cheapestPath finds the matches that explain password with the fewest
+// bits, the characters between them are brute forced.
+func cheapestPath(runes []rune, inputs map[string]int) ([]match, float64) {
+	n := len(runes)
+	if n == 0 {
+		return nil, 0
+	}
+
+	charBits := math.Log2(float64(poolSize(runes)))
+
+	matchesByEnd := make([][]match, n+1)
+	for _, m := range findMatches(runes, inputs) {
+		matchesByEnd[m.end] = append(matchesByEnd[m.end], m)
+	}
+
+	best := make([]float64, n+1)
+	via := make([]*match, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = best[i-1] + charBits
+		via[i] = nil
+
+		for j := range matchesByEnd[i] {
+			m := &matchesByEnd[i][j]
+			if bits := best[m.start] + m.bits; bits < best[i] {
+				best[i] = bits
+				via[i] = m
+			}
+		}
+	}
+
+	var path []match
+	for i := n; i > 0; {
+		if via[i] == nil {
+			i--
+			continue
+		}
+
+		path = append(path, *via[i])
+		i = via[i].start
+	}
+
+	return path, best[n]
+}
+
+func findMatches(runes []rune, inputs map[string]int) []match {
+	var matches []match
+
+	matches = append(matches, dictionaryMatches(runes, common, kindCommon)...)
+	matches = append(matches, dictionaryMatches(runes, inputs, kindUserInput)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	return matches
+}
+
+func dictionaryMatches(runes []rune, dictionary map[string]int, k kind) []match {
+	var matches []match
+
+	for i := range runes {
+		for j := i + 3; j <= len(runes) && j-i <= maxWordLength; j++ {
+			token := runes[i:j]
+			variationBits := caseBits(token)
+
+			for _, candidate := range unleet(token) {
+				word := strings.ToLower(string(candidate.runes))
+				bits := variationBits + candidate.bits
+
+				rank, ok := dictionary[word]
+				if !ok {
+					rank, ok = dictionary[reverse(word)]
+					bits++
+				}
+
+				if ok {
+					matches = append(matches, match{start: i, end: j, kind: k, bits: math.Log2(float64(rank)) + bits, leet: candidate.bits > 0})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+// repeatMatches finds a character or a chunk repeated at least twice, like
+// "aaa" or "abcabc".
+func repeatMatches(runes []rune) []match {
+	var matches []match
+
+	for i := range runes {
+		for size := 1; size <= (len(runes)-i)/2; size++ {
+			count := 1
+			for i+(count+1)*size <= len(runes) && string(runes[i:i+size]) == string(runes[i+count*size:i+(count+1)*size]) {
+				count++
+			}
+
+			if count < 2 || (size == 1 && count < 3) {
+				continue
+			}
+
+			_, baseBits := cheapestPath(runes[i:i+size], nil)
+			matches = append(matches, match{start: i, end: i + count*size, kind: kindRepeat, bits: baseBits + math.Log2(float64(count))})
+		}
+	}
+
+	return matches
+}
+
+// sequenceMatches finds runs like "abcd", "9876" or "bdfh" with a constant
+// step.
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+
+	for i := 0; i+2 < len(runes); {
+		step := runes[i+1] - runes[i]
+		if step == 0 || step > 5 || step < -5 || !sameClass(runes[i], runes[i+1]) {
+			i++
+			continue
+		}
+
+		j := i + 2
+		for j < len(runes) && runes[j]-runes[j-1] == step && sameClass(runes[j-1], runes[j]) {
+			j++
+		}
+
+		if j-i >= 3 {
+			bits := 4.7 // any lowercase start
+			if unicode.IsDigit(runes[i]) {
+				bits = 3.3
+			} else if unicode.IsUpper(runes[i]) {
+				bits = 5.7
+			}
+			if step < 0 {
+				bits++
+			}
+
+			matches = append(matches, match{start: i, end: j, kind: kindSequence, bits: bits + math.Log2(float64(j-i))})
+		}
+
+		i = j - 1
+	}
+
+	return matches
+}
+
+// keyboardMatches finds runs of at least four neighbouring keys on one row,
+// in either direction.
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+
+	lower := []rune(strings.ToLower(string(runes)))
+	for _, row := range keyboardRows {
+		for _, line := range []string{row, reverse(row)} {
+			for i := range lower {
+				j := i
+				for j < len(lower) && strings.Contains(line, string(lower[i:j+1])) {
+					j++
+				}
+
+				if j-i >= 4 {
+					// A start key, a direction and the length.
+					bits := math.Log2(float64(len(line))) + 1 + math.Log2(float64(j-i)) + caseBits(runes[i:j])
+					matches = append(matches, match{start: i, end: j, kind: kindKeyboard, bits: bits})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+func yearMatches(runes []rune) []match {
+	var matches []match
+
+	for i := 0; i+4 <= len(runes); i++ {
+		year := string(runes[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && isDigits(year) {
+			// About the last 120 years are likely.
+			matches = append(matches, match{start: i, end: i + 4, kind: kindYear, bits: math.Log2(120)})
+		}
+	}
+
+	return matches
+}
+
+func feedback(runes []rune, path []match, score int) (string, []string) {
+	var warning string
+	var suggestions []string
+
+	seen := make(map[kind]bool)
+	leet := false
+	for _, m := range path {
+		seen[m.kind] = true
+		leet = leet || m.leet
+	}
+
+	switch {
+	case seen[kindCommon] && len(path) == 1 && path[0].start == 0 && path[0].end == len(runes):
+		warning = "This is one of the most common passwords."
+	case seen[kindUserInput]:
+		warning = "The password contains your login or the name of the entry."
+	case seen[kindCommon]:
+		warning = "Common words are easy to guess."
+	case seen[kindKeyboard]:
+		warning = "Keyboard patterns like \"qwerty\" are easy to guess."
+	case seen[kindSequence]:
+		warning = "Sequences like \"abc\" or \"6543\" are easy to guess."
+	case seen[kindRepeat]:
+		warning = "Repeats like \"aaa\" or \"abcabc\" are easy to guess."
+	case seen[kindYear]:
+		warning = "Years are easy to guess."
+	}
+
+	if score >= Acceptable && len(runes) >= MinLength {
+		return "", nil
+	}
+
+	if len(runes) < MinLength {
+		suggestions = append(suggestions, "Use at least 12 characters.")
+	}
+	if seen[kindCommon] || seen[kindUserInput] {
+		suggestions = append(suggestions, "Add more words that are less common, or use a generated passphrase.")
+	}
+	if leet {
+		suggestions = append(suggestions, "Substitutions like \"@\" instead of \"a\" don't help much.")
+	}
+	if seen[kindYear] {
+		suggestions = append(suggestions, "Avoid years and dates that are associated with you.")
+	}
+	if seen[kindKeyboard] || seen[kindSequence] || seen[kindRepeat] {
+		suggestions = append(suggestions, "Avoid repeated characters, sequences and keyboard patterns.")
+	}
+	if len(suggestions) == 0 {
+		suggestions = append(suggestions, "Mix upper and lower case letters, digits and symbols.")
+	}
+
+	return warning, suggestions
+}
+
+type leetCandidate struct {
+	runes []rune
+	bits  float64
+}
+
+// unleet returns token itself and, if it has substitutions, the tokens with
+// them undone. Every substituted character costs a bit.
+func unleet(token []rune) []leetCandidate {
+	candidates := []leetCandidate{{runes: token}}
+
+	for i, r := range token {
+		subs, ok := leetSubstitutions[r]
+		if !ok {
+			continue
+		}
+
+		var next []leetCandidate
+		for _, candidate := range candidates {
+			next = append(next, candidate)
+			for _, sub := range subs {
+				replaced := append([]rune(nil), candidate.runes...)
+				replaced[i] = sub
+				next = append(next, leetCandidate{runes: replaced, bits: candidate.bits + 1})
+			}
+		}
+
+		// Tokens with lots of digits are rarely words, don't let the
+		// candidates explode.
+		if len(next) > 64 {
+			return candidates[:1]
+		}
+		candidates = next
+	}
+
+	return candidates
+}
+
+// caseBits is the cost of the capitalization: none for all lower, a bit for
+// a capitalized or all upper word, more for anything else.
+func caseBits(token []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 0
+	case lower == 0, upper == 1 && unicode.IsUpper(token[0]):
+		return 1
+	}
+
+	return float64(min(upper, lower)) + 1
+}
+
+func poolSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			size += class.size
+		}
+	}
+
+	return size
+}
+
+func rankedDictionary(words []string) map[string]int {
+	dictionary := make(map[string]int, len(words))
+	for i, word := range words {
+		if _, ok := dictionary[word]; !ok {
+			dictionary[word] = i + 1
+		}
+	}
+
+	return dictionary
+}
+
+func sameClass(a, b rune) bool {
+	return (unicode.IsDigit(a) && unicode.IsDigit(b)) ||
+		(unicode.IsLower(a) && unicode.IsLower(b)) ||
+		(unicode.IsUpper(a) && unicode.IsUpper(b))
+}
+
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,48 @@
+package strength_test
+
+import (
+	"password-guard-bot/pkg/strength"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	estimator := strength.NewEstimator()
+
+	tests := []struct {
+		name        string
+		password    string
+		userInputs  []string
+		maxScore    int
+		minScore    int
+		wantWarning bool
+	}{
+		{name: "Common password", password: "password", maxScore: 0, wantWarning: true},
+		{name: "Leet common password", password: "P@ssw0rd", maxScore: 1, wantWarning: true},
+		{name: "Reversed common password", password: "drowssap", maxScore: 1, wantWarning: true},
+		{name: "Keyboard pattern", password: "qwertyuiop", maxScore: 1, wantWarning: true},
+		{name: "Sequence", password: "abcdefgh", maxScore: 1, wantWarning: true},
+		{name: "Repeat", password: "aaaaaaaaaaaa", maxScore: 1, wantWarning: true},
+		{name: "Word and year", password: "dragon1987", maxScore: 2, wantWarning: true},
+		{name: "Login in password", password: "johnsmith!", userInputs: []string{"john.smith@example.com"}, maxScore: 2, wantWarning: true},
+		{name: "Random password", password: "vR7#kq2!Lm9@xZ4p", minScore: 4, maxScore: 4},
+		{name: "Passphrase", password: "correct-horse-battery-staple", minScore: 4, maxScore: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := estimator.Estimate(test.password, test.userInputs...)
+
+			if got.Score < test.minScore || got.Score > test.maxScore {
+				t.Errorf("Estimate() score = %d (%.1f bits), want %d..%d", got.Score, got.Entropy, test.minScore, test.maxScore)
+			}
+
+			if (got.Warning != "") != test.wantWarning {
+				t.Errorf("Estimate() warning = %q, want warning %v", got.Warning, test.wantWarning)
+			}
+
+			if got.Score < strength.Acceptable && len(got.Suggestions) == 0 {
+				t.Errorf("Estimate() has no suggestions for score %d", got.Score)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSecret is returned by Parse for anything that is neither an
+// otpauth:// URI nor a base32 secret.
+var ErrInvalidSecret = errors.New("invalid totp secret")
+
+// Key holds everything needed to compute RFC 6238 codes.
+type Key struct {
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	Period    int
+	Issuer    string
+	Account   string
+}
+
+// Parse accepts an otpauth://totp/ URI or a bare base32 secret, the way
+// most sites show it: any case, with spaces and without padding.
+func Parse(s string) (*Key, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(strings.ToLower(s), "otpauth://") {
+		return parseURI(s)
+	}
+
+	secret, err := decodeSecret(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{Secret: secret, Algorithm: "SHA1", Digits: 6, Period: 30}, nil
+}
+
+func parseURI(s string) (*Key, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host != "totp" {
+		return nil, ErrInvalidSecret
+	}
+
+	query := u.Query()
+
+	secret, err := decodeSecret(query.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{Secret: secret, Algorithm: "SHA1", Digits: 6, Period: 30, Issuer: query.Get("issuer")}
+
+	label := strings.TrimPrefix(u.Path, "/")
+	if issuer, account, ok := strings.Cut(label, ":"); ok {
+		key.Account = strings.TrimSpace(account)
+		if key.Issuer == "" {
+			key.Issuer = issuer
+		}
+	} else {
+		key.Account = label
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		key.Algorithm = strings.ToUpper(algorithm)
+		if key.Algorithm != "SHA1" && key.Algorithm != "SHA256" && key.Algorithm != "SHA512" {
+			return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidSecret, algorithm)
+		}
+	}
+
+	if digits := query.Get("digits"); digits != "" {
+		key.Digits, err = strconv.Atoi(digits)
+		if err != nil || key.Digits < 6 || key.Digits > 8 {
+			return nil, fmt.Errorf("%w: unsupported digits %s", ErrInvalidSecret, digits)
+		}
+	}
+
+	if period := query.Get("period"); period != "" {
+		key.Period, err = strconv.Atoi(period)
+		if err != nil || key.Period <= 0 {
+			return nil, fmt.Errorf("%w: unsupported period %s", ErrInvalidSecret, period)
+		}
+	}
+
+	return key, nil
+}
+
+func decodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	s = strings.TrimRight(s, "=")
+	if s == "" {
+		return nil, ErrInvalidSecret
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidSecret
+	}
+
+	return secret, nil
+}
+
+// Code returns the code valid at t and the number of seconds it stays
+// valid.
+func (k *Key) Code(t time.Time) (string, int) {
+	period := int64(k.Period)
+	counter := t.Unix() / period
+	remaining := int(period - t.Unix()%period)
+
+	return hotp(k.hash(), k.Secret, uint64(counter), k.Digits), remaining
+}
+
+func (k *Key) hash() func() hash.Hash {
+	switch k.Algorithm {
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	}
+
+	return sha1.New
+}
+
+// hotp is the RFC 4226 algorithm, TOTP only derives the counter from time.
+func hotp(h func() hash.Hash, secret []byte, counter uint64, digits int) string {
+	mac := hmac.New(h, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
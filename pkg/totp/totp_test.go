@@ -0,0 +1,104 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"password-guard-bot/pkg/totp"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238, appendix B.
+func TestCode(t *testing.T) {
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+
+	tests := []struct {
+		time      int64
+		algorithm string
+		want      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1234567890, "SHA1", "89005924"},
+		{2000000000, "SHA256", "90698825"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.algorithm, func(t *testing.T) {
+			secret := base32.StdEncoding.EncodeToString([]byte(secrets[test.algorithm]))
+			key, err := totp.Parse("otpauth://totp/Example:alice?secret=" + secret + "&algorithm=" + test.algorithm + "&digits=8")
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			got, remaining := key.Code(time.Unix(test.time, 0))
+			if got != test.want {
+				t.Errorf("Code() got = %s, want %s", got, test.want)
+			}
+
+			if want := 30 - int(test.time%30); remaining != want {
+				t.Errorf("Code() remaining = %d, want %d", remaining, want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      totp.Key
+		wantError bool
+	}{
+		{
+			name:  "Base32 with spaces",
+			input: "jbsw y3dp ehpk 3pxp",
+			want:  totp.Key{Algorithm: "SHA1", Digits: 6, Period: 30},
+		},
+		{
+			name:  "URI with issuer in label",
+			input: "otpauth://totp/GitHub:alice?secret=JBSWY3DPEHPK3PXP&period=60",
+			want:  totp.Key{Algorithm: "SHA1", Digits: 6, Period: 60, Issuer: "GitHub", Account: "alice"},
+		},
+		{
+			name:      "Not base32",
+			input:     "not a secret!",
+			wantError: true,
+		},
+		{
+			name:      "HOTP URI",
+			input:     "otpauth://hotp/GitHub:alice?secret=JBSWY3DPEHPK3PXP",
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := totp.Parse(test.input)
+			if (err != nil) != test.wantError {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, test.wantError)
+			}
+
+			if test.wantError {
+				return
+			}
+
+			if string(got.Secret) != "Hello!\xde\xad\xbe\xef" {
+				t.Errorf("Parse() secret = %x", got.Secret)
+			}
+
+			if got.Algorithm != test.want.Algorithm || got.Digits != test.want.Digits || got.Period != test.want.Period ||
+				got.Issuer != test.want.Issuer || got.Account != test.want.Account {
+				t.Errorf("Parse() got = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}